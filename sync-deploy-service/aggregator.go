@@ -0,0 +1,298 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	defaultQuietMs      = 3000
+	defaultMaxLatencyMs = 10000
+	// inotify的mv是紧挨着的Rename和Create，隔得久的Create是另外的新建
+	renamePairWindow = 100 * time.Millisecond
+)
+
+// 同一路径多次事件合并后的状态
+type changeState int
+
+const (
+	stateWritten  changeState = iota // server上原来就有，改了内容
+	stateCreated                     // 本批新建，server上原来没有
+	stateRemoved                     // 删除
+	stateReplaced                    // 删除后又新建了同名文件/目录，先删再建
+)
+
+type pathChange struct {
+	seq        int64
+	state      changeState
+	filePath   string
+	oldPath    string // 仅改名
+	isDir      bool
+	removedDir bool // stateRemoved、stateReplaced时被删的是不是目录
+}
+
+// changeAggregator 按路径合并监听事件，静默quiet后或最早的改动等了maxLatency后整批取出，
+// 每个事件要么随某一批同步，要么按语义合并掉（如新建后又删除），不会丢
+type changeAggregator struct {
+	mut         sync.Mutex
+	profile     *syncProfile
+	baseAbsPath string
+	quiet       time.Duration
+	maxLatency  time.Duration
+	seq         int64
+	changes     map[string]*pathChange // 每个路径最后的状态
+	renames     []*pathChange          // 改名涉及两个路径，单独按顺序保留
+	rename      *WatchEvent            // 等待配对Create的Rename事件
+	renameAt    time.Time
+	firstAt     time.Time
+	lastAt      time.Time
+}
+
+func newChangeAggregator(p *syncProfile, baseAbsPath string, quiet time.Duration, maxLatency time.Duration) *changeAggregator {
+	if quiet <= 0 {
+		quiet = defaultQuietMs * time.Millisecond
+	}
+	if maxLatency <= 0 {
+		maxLatency = defaultMaxLatencyMs * time.Millisecond
+	}
+	if maxLatency < quiet {
+		maxLatency = quiet
+	}
+	return &changeAggregator{
+		profile:     p,
+		baseAbsPath: baseAbsPath,
+		quiet:       quiet,
+		maxLatency:  maxLatency,
+		changes:     make(map[string]*pathChange),
+	}
+}
+
+func (agg *changeAggregator) relativePath(name string) string {
+	eventAbsPath, _ := filepath.Abs(name)
+	return strings.Replace(eventAbsPath, agg.baseAbsPath, "", 1)
+}
+
+// Add 记录一个监听事件
+func (agg *changeAggregator) Add(ev WatchEvent) {
+	agg.mut.Lock()
+	defer agg.mut.Unlock()
+	now := time.Now()
+	if agg.firstAt.IsZero() {
+		agg.firstAt = now
+	}
+	agg.lastAt = now
+	agg.profile.log.Printf(PreLog + " change filePath: %s, op: %v", agg.relativePath(ev.Body.Name), ev.Body.Op)
+
+	// inotify的mv是紧挨着的Rename(旧路径)和Create(新路径)
+	if agg.rename != nil {
+		rename := agg.rename
+		agg.rename = nil
+		if ev.Body.Op&fsnotify.Create == fsnotify.Create && ev.IsDir == rename.IsDir && now.Sub(agg.renameAt) <= renamePairWindow {
+			agg.addRename(agg.relativePath(rename.Body.Name), agg.relativePath(ev.Body.Name), ev.IsDir)
+			return
+		}
+		// 移出了监听范围，当作删除
+		agg.addRemove(agg.relativePath(rename.Body.Name), rename.IsDir)
+	}
+
+	filePath := agg.relativePath(ev.Body.Name)
+	switch {
+	case ev.Body.Op&fsnotify.Rename == fsnotify.Rename:
+		agg.rename = &ev
+		agg.renameAt = now
+	case ev.Body.Op&fsnotify.Remove == fsnotify.Remove:
+		agg.addRemove(filePath, ev.IsDir)
+	case ev.Body.Op&fsnotify.Create == fsnotify.Create:
+		agg.addCreate(filePath, ev.IsDir)
+	case ev.IsDir:
+		// 目录本身的写入、改权限不用同步
+	default:
+		agg.addWrite(filePath)
+	}
+}
+
+func (agg *changeAggregator) nextSeq() int64 {
+	agg.seq++
+	return agg.seq
+}
+
+func (agg *changeAggregator) addCreate(filePath string, isDir bool) {
+	change := agg.changes[filePath]
+	switch {
+	case change == nil:
+		change = &pathChange{filePath: filePath, state: stateCreated}
+		agg.changes[filePath] = change
+	case change.state == stateRemoved:
+		// 删了又建：同是文件就是改写，否则先删再建
+		if !isDir && !change.removedDir {
+			change.state = stateWritten
+		} else {
+			change.state = stateReplaced
+		}
+	}
+	change.isDir = isDir
+	change.seq = agg.nextSeq()
+}
+
+func (agg *changeAggregator) addWrite(filePath string) {
+	change := agg.changes[filePath]
+	if change == nil {
+		change = &pathChange{filePath: filePath, state: stateWritten}
+		agg.changes[filePath] = change
+	} else if change.state == stateRemoved {
+		change.state = stateWritten
+	}
+	change.seq = agg.nextSeq()
+}
+
+func (agg *changeAggregator) addRemove(filePath string, isDir bool) {
+	change := agg.changes[filePath]
+	if change != nil && change.state == stateCreated {
+		// 本批新建又删掉，server上本来就没有
+		delete(agg.changes, filePath)
+		if agg.profile.conf.Debug {
+			agg.profile.log.Printf(PreLog + " %s created and removed, dropped", filePath)
+		}
+		return
+	}
+	if change == nil {
+		change = &pathChange{filePath: filePath, removedDir: isDir}
+		agg.changes[filePath] = change
+	} else if change.state == stateWritten {
+		change.removedDir = isDir
+	}
+	// stateReplaced时被删的还是最初那个
+	change.state = stateRemoved
+	change.seq = agg.nextSeq()
+}
+
+func (agg *changeAggregator) addRename(oldPath string, newPath string, isDir bool) {
+	if oldPath == newPath {
+		// 如IntelliJ的safe-write：原文件改名成被排除的___jb_old___，临时文件再改名回来，相当于改写
+		if isDir {
+			agg.addRemove(oldPath, true)
+			agg.addCreate(newPath, true)
+		} else {
+			agg.addWrite(newPath)
+		}
+		return
+	}
+	oldChange := agg.changes[oldPath]
+	// 旧路径及其下、新路径及其下的写入会按新路径重新扫描，删除要在改名前执行，保留
+	for filePath, change := range agg.changes {
+		if !isSameOrSubPath(oldPath, filePath) && !isSameOrSubPath(newPath, filePath) {
+			continue
+		}
+		switch change.state {
+		case stateRemoved:
+		case stateReplaced:
+			change.state = stateRemoved
+		default:
+			delete(agg.changes, filePath)
+		}
+	}
+	if oldChange != nil && oldChange.state == stateCreated {
+		// server上没有旧路径，按新建处理
+		agg.addCreate(newPath, isDir)
+		return
+	}
+	agg.renames = append(agg.renames, &pathChange{
+		seq:      agg.nextSeq(),
+		filePath: newPath,
+		oldPath:  oldPath,
+		isDir:    isDir,
+	})
+}
+
+// Flush 到了发送时机就取出合并后的改动，按发生顺序排列
+func (agg *changeAggregator) Flush(now time.Time) []FileMeta {
+	agg.mut.Lock()
+	defer agg.mut.Unlock()
+	if agg.firstAt.IsZero() {
+		return nil
+	}
+	if now.Sub(agg.lastAt) < agg.quiet && now.Sub(agg.firstAt) < agg.maxLatency {
+		return nil
+	}
+	if agg.rename != nil {
+		// 等不到配对的Create，说明移出了监听范围
+		agg.addRemove(agg.relativePath(agg.rename.Body.Name), agg.rename.IsDir)
+		agg.rename = nil
+	}
+
+	changes := agg.renames
+	for _, change := range agg.changes {
+		changes = append(changes, change)
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].seq < changes[j].seq })
+
+	var fileChanges []FileMeta
+	listed := make(map[string]bool)
+	// 新建、改名过来的目录，里面已有的文件不一定有事件，扫一遍；单独有记录的文件按自己的顺序
+	addWrites := func(filePath string) {
+		for _, writePath := range agg.profile.listWatchFiles(filepath.Join(agg.baseAbsPath, filePath), agg.baseAbsPath) {
+			if _, ok := agg.changes[writePath]; ok || listed[writePath] {
+				continue
+			}
+			listed[writePath] = true
+			fileChanges = append(fileChanges, FileMeta{FilePath: writePath, OptType: OptWrite})
+		}
+	}
+	for _, change := range changes {
+		if change.oldPath != "" {
+			renameMeta := FileMeta{FilePath: change.filePath, OldPath: change.oldPath, OptType: OptRename}
+			// server上没有旧路径时按Mode决定是建目录还是传文件
+			if isDir(filepath.Join(agg.baseAbsPath, change.filePath)) {
+				renameMeta.Mode = os.ModeDir
+			}
+			fileChanges = append(fileChanges, renameMeta)
+			// 改名期间内容可能也变了，新路径下的文件照常diff，没变的server会跳过
+			addWrites(change.filePath)
+			continue
+		}
+		if change.state == stateRemoved || change.state == stateReplaced {
+			if change.removedDir {
+				fileChanges = append(fileChanges, FileMeta{FilePath: change.filePath, OptType: OptRemoveDir})
+			} else {
+				fileChanges = append(fileChanges, FileMeta{FilePath: change.filePath, OptType: OptRemove})
+			}
+			if change.state == stateRemoved {
+				continue
+			}
+		}
+		if change.isDir {
+			fileChanges = append(fileChanges, FileMeta{FilePath: change.filePath, OptType: OptMkdir})
+			addWrites(change.filePath)
+		} else {
+			fileChanges = append(fileChanges, FileMeta{FilePath: change.filePath, OptType: OptWrite})
+		}
+	}
+
+	agg.changes = make(map[string]*pathChange)
+	agg.renames = nil
+	agg.firstAt = time.Time{}
+	return fileChanges
+}
+
+func isSameOrSubPath(dirPath string, filePath string) bool {
+	return filePath == dirPath || strings.HasPrefix(filePath, dirPath+string(filepath.Separator))
+}
+
+// listWatchFiles 列出目录下需要同步的文件，传入的是文件时返回它自己
+func (p *syncProfile) listWatchFiles(root string, baseAbsPath string) []string {
+	var filePaths []string
+	_ = p.walkWatchPaths(root, func(path string, info os.FileInfo) {
+		if info.IsDir() {
+			return
+		}
+		absPath, _ := filepath.Abs(path)
+		filePaths = append(filePaths, strings.Replace(absPath, baseAbsPath, "", 1))
+	})
+	return filePaths
+}
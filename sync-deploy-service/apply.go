@@ -0,0 +1,510 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 单个文件的同步结果
+const (
+	SyncOk      = "ok"
+	SyncSkipped = "skipped"
+	SyncFailed  = "failed"
+)
+
+type (
+	SyncFileResult struct {
+		FilePath string
+		Status   string
+		Reason   string
+		Hash     string // 成功写入后server上文件的hash
+		Retry    bool   // 临时性失败，client可以重试
+	}
+	// SyncRes 回复给发起sync的client，Error不为空表示整批已回滚
+	SyncRes struct {
+		Results []SyncFileResult
+		Error   string
+	}
+)
+
+// applyStep 一次批量写入里单个文件的操作记录，失败时按记录回滚
+type applyStep struct {
+	filePath   string
+	backupPath string // 原文件挪到这里，为空表示原来不存在
+	backupDir  bool
+	placed     bool   // 新文件已经放到filePath
+	renamedFrom string // 从这个路径改名过来的
+	createdDirs []string
+	// 只改属性时记下原来的权限和修改时间
+	attrOnly   bool
+	oldMode    os.FileMode
+	oldModTime time.Time
+	removedDir bool
+}
+
+// applyBatch 把一次SyncReq当作一个事务：分片阶段写好的临时文件在这里才rename到位，
+// 原文件先挪成备份，任意一步失败就按相反顺序恢复，全部成功后再删备份
+func (session *Session) applyBatch(fileMetas []FileMeta) SyncRes {
+	results := make([]SyncFileResult, len(fileMetas))
+	for index, fileMeta := range fileMetas {
+		results[index] = SyncFileResult{FilePath: fileMeta.FilePath}
+	}
+	var steps []*applyStep
+	failed, err := session.applyFileMetas(fileMetas, results, &steps)
+	if err != nil {
+		for i := len(steps) - 1; i >= 0; i-- {
+			if rbErr := steps[i].rollback(); rbErr != nil {
+				log.Printf(PreError+" rollback %s err: %v", steps[i].filePath, rbErr)
+			}
+		}
+		// 本批没用上的临时文件也丢掉，client重试时会重新上传
+		for filePath, staged := range session.staged {
+			delete(session.staged, filePath)
+			_ = os.Remove(staged.tmpPath)
+		}
+		// 受牵连回滚的文件本身没问题，可以重试
+		for index := range results {
+			if index == failed {
+				results[index] = SyncFileResult{fileMetas[index].FilePath, SyncFailed, err.Error(), "", isTransientErr(err)}
+			} else if results[index].Status != SyncSkipped {
+				results[index] = SyncFileResult{fileMetas[index].FilePath, SyncFailed, "rolled back", "", true}
+			}
+		}
+		return SyncRes{results, fmt.Sprintf("%s: %v", fileMetas[failed].FilePath, err)}
+	}
+	for _, step := range steps {
+		if step.backupDir {
+			_ = os.RemoveAll(step.backupPath)
+		} else if step.backupPath != "" {
+			_ = os.Remove(step.backupPath)
+		}
+	}
+	return SyncRes{Results: results}
+}
+
+// applyFileMetas 逐个应用，出错时返回出错文件的下标
+func (session *Session) applyFileMetas(fileMetas []FileMeta, results []SyncFileResult, steps *[]*applyStep) (int, error) {
+	removedDirs := make(map[string]int)
+	for index, fileMeta := range fileMetas {
+		result := &results[index]
+		filePath, err := session.project.resolveSyncPath(fileMeta.FilePath)
+		if err == errPathProtected {
+			result.Status, result.Reason = SyncSkipped, err.Error()
+			continue
+		}
+		if err != nil {
+			return index, err
+		}
+		switch {
+		case fileMeta.OptType == OptRemove:
+			// 删文件
+			stat, err := os.Lstat(filePath)
+			if err != nil {
+				result.Status, result.Reason = SyncSkipped, "not exists"
+				continue
+			}
+			if stat.IsDir() {
+				removedDirs[filePath] = index
+				continue
+			}
+			step := &applyStep{filePath: filePath}
+			*steps = append(*steps, step)
+			if err := step.backup(session.Id, len(*steps), false); err != nil {
+				return index, err
+			}
+			result.Status = SyncOk
+			log.Println("file removed", filePath)
+		case fileMeta.OptType == OptRemoveDir:
+			// 整个目录挪成备份，成功后再删
+			if _, err := os.Lstat(filePath); err != nil {
+				result.Status, result.Reason = SyncSkipped, "not exists"
+				continue
+			}
+			if session.project.containsProtectedPath(filePath) {
+				result.Status, result.Reason = SyncSkipped, "contains protected path"
+				continue
+			}
+			step := &applyStep{filePath: filePath}
+			*steps = append(*steps, step)
+			if err := step.backup(session.Id, len(*steps), true); err != nil {
+				return index, err
+			}
+			result.Status = SyncOk
+			log.Println("dir removed", filePath)
+		case fileMeta.OptType == OptMkdir:
+			if isDir(filePath) {
+				result.Status, result.Reason = SyncSkipped, "exists"
+				continue
+			}
+			step := &applyStep{filePath: filePath}
+			*steps = append(*steps, step)
+			if err := step.mkdirAll(filePath); err != nil {
+				return index, err
+			}
+			result.Status = SyncOk
+			log.Println("dir created", filePath)
+		case fileMeta.OptType == OptRename:
+			oldPath, err := session.project.resolveSyncPath(fileMeta.OldPath)
+			if err == errPathProtected {
+				result.Status, result.Reason = SyncSkipped, err.Error()
+				continue
+			}
+			if err != nil {
+				return index, err
+			}
+			if oldPath == filePath {
+				result.Status, result.Reason = SyncSkipped, "same path"
+				continue
+			}
+			if _, err := os.Lstat(oldPath); err != nil {
+				// 旧路径不在server上：目录直接建；文件要有本批传来的内容，否则让client重传
+				if fileMeta.Mode.IsDir() {
+					step := &applyStep{filePath: filePath}
+					*steps = append(*steps, step)
+					if err := step.mkdirAll(filePath); err != nil {
+						return index, err
+					}
+					result.Status = SyncOk
+					log.Println("dir created", filePath)
+					continue
+				}
+				if _, ok := session.staged[filePath]; ok {
+					result.Status, result.Reason = SyncSkipped, "source not exists, content sent"
+					continue
+				}
+				return index, errRenameSourceMissing
+			}
+			if session.project.containsProtectedPath(oldPath) {
+				result.Status, result.Reason = SyncSkipped, "contains protected path"
+				continue
+			}
+			step := &applyStep{filePath: filePath}
+			*steps = append(*steps, step)
+			if err := step.backup(session.Id, len(*steps), false); err != nil {
+				return index, err
+			}
+			if err := step.mkdirAll(filepath.Dir(filePath)); err != nil {
+				return index, err
+			}
+			if err := os.Rename(oldPath, filePath); err != nil {
+				return index, err
+			}
+			step.renamedFrom = oldPath
+			if err := session.project.checkMovedLinks(filePath); err != nil {
+				return index, err
+			}
+			result.Status = SyncOk
+			log.Printf(PreLog+" sync, rename %s -> %s", fileMeta.OldPath, fileMeta.FilePath)
+		case fileMeta.AttrOnly:
+			stat, err := os.Lstat(filePath)
+			if err != nil {
+				return index, err
+			}
+			// chmod会跟随软链接
+			if !stat.Mode().IsRegular() {
+				return index, fmt.Errorf("%s is not a regular file", fileMeta.FilePath)
+			}
+			step := &applyStep{filePath: filePath, attrOnly: true, oldMode: stat.Mode().Perm(), oldModTime: stat.ModTime()}
+			*steps = append(*steps, step)
+			if err := applyFileAttrs(filePath, fileMeta); err != nil {
+				return index, err
+			}
+			result.Status = SyncOk
+			result.Hash, _ = session.appliedHash(filePath)
+		case fileMeta.LinkTarget != "":
+			if linkMatches(filePath, fileMeta) {
+				result.Status, result.Reason = SyncSkipped, "link unchanged"
+				result.Hash, _ = session.appliedHash(filePath)
+				continue
+			}
+			if !attrEnabled(serverConf.SkipAttrs, AttrSymlink) {
+				result.Status, result.Reason = SyncSkipped, "symlink disabled by skip-attrs"
+				continue
+			}
+			if err := session.project.checkLinkTarget(filePath, fileMeta.LinkTarget); err != nil {
+				return index, err
+			}
+			step := &applyStep{filePath: filePath}
+			*steps = append(*steps, step)
+			if err := step.backup(session.Id, len(*steps), false); err != nil {
+				return index, err
+			}
+			if err := step.mkdirAll(filepath.Dir(filePath)); err != nil {
+				return index, err
+			}
+			if err := applyFileAttrs(filePath, fileMeta); err != nil {
+				return index, err
+			}
+			step.placed = true
+			result.Status = SyncOk
+			result.Hash, _ = session.appliedHash(filePath)
+		default:
+			// 内容已经在分片阶段写到临时文件，校验过hash
+			staged, ok := session.staged[filePath]
+			if !ok {
+				return index, errNotReceived
+			}
+			delete(session.staged, filePath)
+			tmpPath := staged.tmpPath
+			step := &applyStep{filePath: filePath}
+			*steps = append(*steps, step)
+			if err := step.backup(session.Id, len(*steps), false); err != nil {
+				_ = os.Remove(tmpPath)
+				return index, err
+			}
+			if err := step.mkdirAll(filepath.Dir(filePath)); err != nil {
+				_ = os.Remove(tmpPath)
+				return index, err
+			}
+			if err := os.Rename(tmpPath, filePath); err != nil {
+				_ = os.Remove(tmpPath)
+				return index, err
+			}
+			step.placed = true
+			if err := applyFileAttrs(filePath, fileMeta); err != nil {
+				return index, err
+			}
+			// 报告server自己算出的hash，不是client声称的
+			result.Status, result.Hash = SyncOk, staged.hash
+			log.Printf(PreLog+" sync, write file success: %s", fileMeta.FilePath)
+		}
+	}
+	// 目录最后删，深的先删；只删空目录，server上还有别的文件时保留
+	dirPaths := make([]string, 0, len(removedDirs))
+	for dirPath := range removedDirs {
+		dirPaths = append(dirPaths, dirPath)
+	}
+	sort.Slice(dirPaths, func(i, j int) bool { return len(dirPaths[i]) > len(dirPaths[j]) })
+	for _, dirPath := range dirPaths {
+		result := &results[removedDirs[dirPath]]
+		stat, err := os.Lstat(dirPath)
+		if err != nil {
+			result.Status, result.Reason = SyncSkipped, "not exists"
+			continue
+		}
+		if err := os.Remove(dirPath); err != nil {
+			result.Status, result.Reason = SyncSkipped, "dir not empty"
+			continue
+		}
+		*steps = append(*steps, &applyStep{filePath: dirPath, removedDir: true, oldMode: stat.Mode().Perm()})
+		result.Status = SyncOk
+		log.Println("file removed", dirPath)
+	}
+	return -1, nil
+}
+
+var (
+	errNotReceived         = errors.New("file content not received")
+	errRenameSourceMissing = errors.New("rename source not exists")
+)
+
+// appliedHash 按server上落盘后的实际内容算hash报告给client，软链接按目标路径算
+func (session *Session) appliedHash(filePath string) (string, error) {
+	stat, err := os.Lstat(filePath)
+	if err != nil {
+		return "", err
+	}
+	if stat.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(filePath)
+		if err != nil {
+			return "", err
+		}
+		return symlinkHash(session.Hash, target), nil
+	}
+	return calcFileHash(session.Hash, filePath)
+}
+
+// isTransientErr 文件被占用、内容没传到之类的错误，稍后重试可能成功
+func isTransientErr(err error) bool {
+	return errors.Is(err, errNotReceived) || errors.Is(err, errRenameSourceMissing) || errors.Is(err, syscall.ETXTBSY) ||
+		errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.EAGAIN)
+}
+
+// backup 原文件存在时挪到同目录下的备份文件，allowDir时目录也整体挪走；
+// 同一批里同一个路径可能被改多次(先rename过来再写)，备份名带上步骤序号，不能覆盖前一步的备份
+func (step *applyStep) backup(sessionId int64, seq int, allowDir bool) error {
+	stat, err := os.Lstat(step.filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if stat.IsDir() && !allowDir {
+		return fmt.Errorf("%s is a directory", step.filePath)
+	}
+	backupPath := filepath.Join(filepath.Dir(step.filePath),
+		"."+filepath.Base(step.filePath)+".syncds-bak-"+strconv.FormatInt(sessionId, 10)+"-"+strconv.Itoa(seq))
+	_ = os.Remove(backupPath)
+	if err := os.Rename(step.filePath, backupPath); err != nil {
+		return err
+	}
+	step.backupPath = backupPath
+	step.backupDir = stat.IsDir()
+	return nil
+}
+
+// mkdirAll 记下新建的各级目录，回滚时删掉
+func (step *applyStep) mkdirAll(dirPath string) error {
+	var missing []string
+	for dir := dirPath; ; dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		missing = append([]string{dir}, missing...)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(dirPath, os.ModePerm); err != nil {
+		return err
+	}
+	step.createdDirs = append(step.createdDirs, missing...)
+	return nil
+}
+
+func (step *applyStep) rollback() error {
+	if step.removedDir {
+		return os.Mkdir(step.filePath, step.oldMode)
+	}
+	if step.attrOnly {
+		if err := os.Chmod(step.filePath, step.oldMode); err != nil {
+			return err
+		}
+		return os.Chtimes(step.filePath, time.Now(), step.oldModTime)
+	}
+	if step.renamedFrom != "" {
+		if err := os.Rename(step.filePath, step.renamedFrom); err != nil {
+			return err
+		}
+	} else if step.placed {
+		if err := os.Remove(step.filePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if step.backupPath != "" {
+		if err := os.Rename(step.backupPath, step.filePath); err != nil {
+			return err
+		}
+	}
+	for i := len(step.createdDirs) - 1; i >= 0; i-- {
+		_ = os.Remove(step.createdDirs[i])
+	}
+	return nil
+}
+
+// renamedPath 文件在本批改名的目录下时，返回server上改名前的路径
+func renamedPath(renames map[string]string, filePath string) string {
+	for newPath, oldPath := range renames {
+		if filePath == newPath {
+			return oldPath
+		}
+		if strings.HasPrefix(filePath, newPath+string(filepath.Separator)) {
+			return oldPath + filePath[len(newPath):]
+		}
+	}
+	return filePath
+}
+
+// client端
+
+const (
+	maxSyncRetries = 3
+	syncRetryDelay = 2 * time.Second
+)
+
+// handleSyncRes 打印每个文件的同步结果，临时性失败的文件稍后重新走diff
+func (t *syncTarget) handleSyncRes(data string) {
+	var res SyncRes
+	err := json.Unmarshal([]byte(data), &res)
+	if err != nil {
+		t.log.Printf(PreError+" read syncRes err: %v", err)
+		return
+	}
+	counts := make(map[string]int)
+	var retryChanges []FileMeta
+	for _, result := range res.Results {
+		counts[result.Status]++
+		t.retryMut.Lock()
+		fileMeta, ok := t.syncingMetas[result.FilePath]
+		delete(t.syncingMetas, result.FilePath)
+		if result.Status == SyncOk {
+			delete(t.syncRetries, result.FilePath)
+		}
+		t.retryMut.Unlock()
+		if !ok {
+			fileMeta = FileMeta{FilePath: result.FilePath, OptType: OptWrite}
+		}
+		switch result.Status {
+		case SyncOk:
+			if t.profile.conf.Debug {
+				t.log.Printf(PreLog+" sync %s ok, hash %s", result.FilePath, result.Hash)
+			}
+		case SyncSkipped:
+			t.log.Printf(PreLog+" sync %s skipped: %s", result.FilePath, result.Reason)
+		default:
+			t.log.Printf(PreError+" sync %s failed: %s", result.FilePath, result.Reason)
+			if result.Retry {
+				retryChanges = append(retryChanges, fileMeta)
+			}
+		}
+	}
+	t.log.Printf(PreLog+" sync result: %d ok, %d skipped, %d failed", counts[SyncOk], counts[SyncSkipped], counts[SyncFailed])
+	if res.Error != "" {
+		t.log.Printf(PreError+" sync rolled back, deploy skipped, err: %s", res.Error)
+	}
+	if res.Error != "" || counts[SyncFailed] > 0 {
+		t.setStatus(targetFailed, fmt.Sprintf("%d files failed", counts[SyncFailed]), true)
+	} else {
+		t.setStatus(targetUpToDate, "", true)
+	}
+	t.scheduleRetry(retryChanges)
+}
+
+// scheduleRetry 同一个文件最多重试maxSyncRetries次，每次间隔递增；rename、删目录等按原来的操作重试
+func (t *syncTarget) scheduleRetry(failedChanges []FileMeta) {
+	t.retryMut.Lock()
+	defer t.retryMut.Unlock()
+	var fileChanges []FileMeta
+	attempt := 0
+	for _, fileMeta := range failedChanges {
+		filePath := fileMeta.FilePath
+		if t.syncRetries[filePath] >= maxSyncRetries {
+			t.log.Printf(PreError+" sync %s failed after %d retries, give up", filePath, maxSyncRetries)
+			delete(t.syncRetries, filePath)
+			continue
+		}
+		t.syncRetries[filePath]++
+		if t.syncRetries[filePath] > attempt {
+			attempt = t.syncRetries[filePath]
+		}
+		if fileMeta.OptType == OptWrite || fileMeta.OptType == OptRemove {
+			// 按本地现状重新判断是写还是删，写的内容发送前重新读
+			fileMeta = FileMeta{FilePath: filePath, OptType: OptWrite}
+			if _, err := os.Lstat(filepath.Join(t.profile.conf.BaseDir, filePath)); os.IsNotExist(err) {
+				fileMeta.OptType = OptRemove
+			}
+		}
+		fileMeta.Signature = nil
+		fileChanges = append(fileChanges, fileMeta)
+	}
+	if len(fileChanges) == 0 {
+		return
+	}
+	delay := syncRetryDelay * time.Duration(attempt)
+	t.log.Printf(PreLog+" retry %d files in %v", len(fileChanges), delay)
+	time.AfterFunc(delay, func() {
+		if !t.recordOfflineChanges(fileChanges) {
+			t.handleChanges(fileChanges)
+		}
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newApplySession(t *testing.T) (*Session, string) {
+	baseDir := t.TempDir()
+	sp := newServerProject(ServerConf{}, ServerProjectConf{BaseDir: baseDir})
+	return &Session{Id: 7, project: sp, staged: make(map[string]stagedFile)}, baseDir
+}
+
+func writeTestFile(t *testing.T, filePath string, content string) {
+	if err := ioutil.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t *testing.T, filePath string) string {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("read %s: %v", filePath, err)
+	}
+	return string(data)
+}
+
+// rename到已有文件后又写同一个文件，后面的文件失败时要恢复成同步前的样子
+func TestApplyBatchRollbackSamePathTwice(t *testing.T) {
+	session, baseDir := newApplySession(t)
+	writeTestFile(t, filepath.Join(baseDir, "a"), "ORIGINAL-A")
+	writeTestFile(t, filepath.Join(baseDir, "b"), "ORIGINAL-B")
+	bPath, err := session.project.resolveSyncPath("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpPath := filepath.Join(baseDir, "b.tmp")
+	writeTestFile(t, tmpPath, "NEW-B")
+	session.staged[bPath] = stagedFile{tmpPath, "hash"}
+
+	res := session.applyBatch([]FileMeta{
+		{FilePath: "b", OldPath: "a", OptType: OptRename},
+		{FilePath: "b", OptType: OptWrite},
+		{FilePath: "c", OptType: OptWrite},
+	})
+	if res.Error == "" {
+		t.Fatal("expected the batch to fail on c")
+	}
+	if got := readTestFile(t, filepath.Join(baseDir, "a")); got != "ORIGINAL-A" {
+		t.Errorf("a: got %q", got)
+	}
+	if got := readTestFile(t, filepath.Join(baseDir, "b")); got != "ORIGINAL-B" {
+		t.Errorf("b: got %q", got)
+	}
+	entries, _ := ioutil.ReadDir(baseDir)
+	for _, entry := range entries {
+		if entry.Name() != "a" && entry.Name() != "b" {
+			t.Errorf("left over after rollback: %s", entry.Name())
+		}
+	}
+}
+
+// server上没有旧路径时：目录直接建，文件没有传来内容时整批失败让client重传
+func TestApplyRenameMissingSource(t *testing.T) {
+	session, baseDir := newApplySession(t)
+	res := session.applyBatch([]FileMeta{{FilePath: "new-dir", OldPath: "old-dir", OptType: OptRename, Mode: os.ModeDir}})
+	if res.Error != "" || res.Results[0].Status != SyncOk {
+		t.Fatalf("rename missing dir: %+v", res)
+	}
+	if !isDir(filepath.Join(baseDir, "new-dir")) {
+		t.Error("new-dir should be created")
+	}
+
+	res = session.applyBatch([]FileMeta{{FilePath: "new.txt", OldPath: "old.txt", OptType: OptRename}})
+	if res.Error == "" || !res.Results[0].Retry {
+		t.Errorf("rename missing file: expected a retryable failure, got %+v", res)
+	}
+}
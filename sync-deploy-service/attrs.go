@@ -0,0 +1,118 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// 可以通过skip-attrs关闭的文件属性
+const (
+	AttrMode    = "mode"
+	AttrMtime   = "mtime"
+	AttrSymlink = "symlink"
+)
+
+func attrEnabled(skipAttrs []string, attr string) bool {
+	for _, skip := range skipAttrs {
+		if skip == attr {
+			return false
+		}
+	}
+	return true
+}
+
+// clientSkipAttrs windows上没有可执行位，默认不同步mode，免得把server上脚本的x权限抹掉
+func clientSkipAttrs(conf ClientConf) []string {
+	if conf.SkipAttrs == nil && runtime.GOOS == "windows" {
+		return []string{AttrMode}
+	}
+	return conf.SkipAttrs
+}
+
+// symlinkHash 软链接按目标路径算hash，client、server一致
+func symlinkHash(algo string, target string) string {
+	return hashBytes(algo, []byte("symlink:"+target))
+}
+
+// readFileAttrs client端读取要保留的属性，返回是否是需要按软链接同步
+func readFileAttrs(fileMeta *FileMeta, stat os.FileInfo, filePath string, algo string, skipAttrs []string) (bool, error) {
+	if stat.Mode()&os.ModeSymlink != 0 && attrEnabled(skipAttrs, AttrSymlink) {
+		target, err := os.Readlink(filePath)
+		if err != nil {
+			return false, err
+		}
+		fileMeta.LinkTarget = target
+		fileMeta.Size = int64(len(target))
+		fileMeta.Hash = symlinkHash(algo, target)
+		return true, nil
+	}
+	if stat.Mode()&os.ModeSymlink != 0 {
+		// 不按链接同步时，属性取链接指向的文件
+		var err error
+		if stat, err = os.Stat(filePath); err != nil {
+			return false, err
+		}
+	}
+	if attrEnabled(skipAttrs, AttrMode) {
+		fileMeta.Mode = stat.Mode().Perm()
+	}
+	if attrEnabled(skipAttrs, AttrMtime) {
+		fileMeta.ModTime = stat.ModTime()
+	}
+	return false, nil
+}
+
+// attrsDiffer 内容一致时，判断权限、修改时间是否需要更新
+func attrsDiffer(stat os.FileInfo, fileMeta FileMeta) bool {
+	if fileMeta.Mode != 0 && attrEnabled(serverConf.SkipAttrs, AttrMode) && stat.Mode().Perm() != fileMeta.Mode.Perm() {
+		return true
+	}
+	// 有的文件系统mtime精度只到秒
+	if !fileMeta.ModTime.IsZero() && attrEnabled(serverConf.SkipAttrs, AttrMtime) &&
+		!stat.ModTime().Truncate(time.Second).Equal(fileMeta.ModTime.Truncate(time.Second)) {
+		return true
+	}
+	return false
+}
+
+// linkMatches server上已经是指向同一目标的软链接
+func linkMatches(filePath string, fileMeta FileMeta) bool {
+	target, err := os.Readlink(filePath)
+	return err == nil && target == fileMeta.LinkTarget
+}
+
+// applyFileAttrs server端在文件落盘后恢复软链接、权限、修改时间
+func applyFileAttrs(filePath string, fileMeta FileMeta) error {
+	if fileMeta.LinkTarget != "" {
+		if !attrEnabled(serverConf.SkipAttrs, AttrSymlink) {
+			log.Printf(PreLog+" symlink disabled by skip-attrs, skip %s -> %s", fileMeta.FilePath, fileMeta.LinkTarget)
+			return nil
+		}
+		if linkMatches(filePath, fileMeta) {
+			return nil
+		}
+		if stat, err := os.Lstat(filePath); err == nil && !stat.IsDir() {
+			if err := os.Remove(filePath); err != nil {
+				return err
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+			return err
+		}
+		return os.Symlink(fileMeta.LinkTarget, filePath)
+	}
+	if fileMeta.Mode != 0 && attrEnabled(serverConf.SkipAttrs, AttrMode) {
+		if err := os.Chmod(filePath, fileMeta.Mode.Perm()); err != nil {
+			return err
+		}
+	}
+	if !fileMeta.ModTime.IsZero() && attrEnabled(serverConf.SkipAttrs, AttrMtime) {
+		if err := os.Chtimes(filePath, time.Now(), fileMeta.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const handshakeTimeout = 10 * time.Second
+
+func newChallenge() (string, error) {
+	nonce := make([]byte, 32)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+// signChallenge 用共享密钥对server下发的随机串和项目名做HMAC，密钥本身不在网络上传输
+func signChallenge(secret string, challenge string, project string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(challenge + "\n" + project))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func checkSignature(secret string, challenge string, project string, signature string) bool {
+	if secret == "" {
+		return true
+	}
+	expected := signChallenge(secret, challenge, project)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// authenticate 握手：下发challenge，校验client回复的hello签名，通过后才处理其他请求
+func (session *Session) authenticate() bool {
+	c := session.conn
+	challenge, err := newChallenge()
+	if err != nil {
+		log.Printf(PreError+" session %d gen challenge err: %v", session.Id, err)
+		return false
+	}
+	session.writeJson("challenge", challenge)
+
+	_ = c.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer c.SetReadDeadline(time.Time{})
+	mt, message, err := c.ReadMessage()
+	if err != nil {
+		log.Printf(PreError+" session %d handshake read err: %v", session.Id, err)
+		return false
+	}
+	wsReqMsg := WsReqMessage{}
+	req := HelloReq{}
+	if mt == websocket.BinaryMessage {
+		err = gob.NewDecoder(bytes.NewBuffer(message)).Decode(&wsReqMsg)
+		if err == nil && wsReqMsg.Type == "hello" {
+			err = gob.NewDecoder(bytes.NewBuffer(wsReqMsg.Data)).Decode(&req)
+		}
+	}
+	if mt != websocket.BinaryMessage || err != nil || wsReqMsg.Type != "hello" {
+		log.Printf(PreError+" session %d auth rejected from %s: expect hello, got %s", session.Id, c.RemoteAddr(), wsReqMsg.Type)
+		session.writeHelloRes(HelloRes{Error: "expect hello"})
+		return false
+	}
+	project := findServerProject(req.Project)
+	if project == nil {
+		log.Printf(PreError+" session %d auth rejected from %s: unknown project `%s`", session.Id, c.RemoteAddr(), req.Project)
+		session.writeHelloRes(HelloRes{Error: "unknown project"})
+		return false
+	}
+	if !checkSignature(project.secret, challenge, req.Project, req.Signature) {
+		log.Printf(PreError+" session %d auth rejected from %s: bad signature for project `%s`", session.Id, c.RemoteAddr(), req.Project)
+		session.writeHelloRes(HelloRes{Error: "bad signature"})
+		return false
+	}
+	session.project = project
+	// 协商本连接的参数
+	session.Hash = negotiateHash(req.Hashes, serverConf.Hash)
+	if session.Hash == "" {
+		log.Printf(PreError+" session %d rejected: no common hash algorithm in %v", session.Id, req.Hashes)
+		session.writeHelloRes(HelloRes{Error: "no common hash algorithm"})
+		return false
+	}
+	session.Codec = negotiateCodec(req.Codecs, serverConf.Compress)
+	log.Printf(PreLog+" session %d compress codec: %s, hash: %s", session.Id, session.Codec, session.Hash)
+	session.writeHelloRes(HelloRes{Codec: session.Codec, Hash: session.Hash, LogEpoch: project.outputEpoch})
+	// 握手回复之后再补发deploy输出
+	session.subscribeWithReplay(req.LogEpoch, req.LastSeq)
+	return true
+}
+
+func (session *Session) writeHelloRes(res HelloRes) {
+	resBytes, _ := json.Marshal(res)
+	session.writeJson("authRes", string(resBytes))
+}
+
+// clientHandshake client端握手，等server的challenge，签名后回复hello，返回协商结果
+func (t *syncTarget) clientHandshake(c *websocket.Conn) (HelloRes, error) {
+	var res HelloRes
+	_ = c.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	var challengeMsg WsResMessage
+	err := c.ReadJSON(&challengeMsg)
+	if err != nil {
+		return res, err
+	}
+	if challengeMsg.Type != "challenge" {
+		return res, fmt.Errorf("expect challenge, got %s", challengeMsg.Type)
+	}
+
+	codecs := t.profile.conf.Compress
+	if len(codecs) == 0 {
+		codecs = defaultCodecs
+	}
+	hashes := t.profile.conf.Hash
+	if len(hashes) == 0 {
+		hashes = defaultHashes
+	}
+	t.connMut.Lock()
+	req := HelloReq{
+		t.project,
+		signChallenge(t.secret, challengeMsg.Data, t.project),
+		codecs,
+		hashes,
+		t.logEpoch,
+		t.lastDeploySeq,
+	}
+	t.connMut.Unlock()
+	buf := &bytes.Buffer{}
+	_ = gob.NewEncoder(buf).Encode(req)
+	msgBuf := &bytes.Buffer{}
+	_ = gob.NewEncoder(msgBuf).Encode(WsReqMessage{
+		"hello",
+		buf.Bytes(),
+	})
+	err = c.WriteMessage(websocket.BinaryMessage, msgBuf.Bytes())
+	if err != nil {
+		return res, err
+	}
+
+	var authRes WsResMessage
+	err = c.ReadJSON(&authRes)
+	if err != nil {
+		return res, err
+	}
+	if authRes.Type != "authRes" {
+		return res, fmt.Errorf("expect authRes, got %s", authRes.Type)
+	}
+	err = json.Unmarshal([]byte(authRes.Data), &res)
+	if err != nil {
+		return res, err
+	}
+	if res.Error != "" {
+		return res, errAuthRejected{res.Error}
+	}
+	return res, nil
+}
+
+type errAuthRejected struct {
+	reason string
+}
+
+func (e errAuthRejected) Error() string {
+	return "auth rejected by server: " + e.reason
+}
+
+// requireHttpPassword http页面用basic auth保护，密码是单独的http-password，用户名随意；
+// secret只用于ws的签名认证，不在http里明文传输。配了secret但没配http-password时页面不开放
+func requireHttpPassword(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		password, secured := serverConf.HttpPassword, serverConf.Secret != ""
+		if sp, _ := httpProject(strings.TrimPrefix(r.URL.Path, "/")); sp != nil {
+			// 项目下的页面用项目的http-password
+			password, secured = sp.httpPassword, sp.secret != ""
+		} else {
+			// 多项目时根路径列出所有项目，任一项目配了secret就不能公开
+			for _, sp := range allServerProjects() {
+				secured = secured || sp.secret != ""
+			}
+		}
+		if password == "" {
+			if secured {
+				log.Printf(PreError+" http rejected from %s, path %s: no http-password configured", r.RemoteAddr, r.URL.Path)
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = fmt.Fprintf(w, "set http-password in %s to view this page", fileNameServerConfig)
+				return
+			}
+			handler(w, r)
+			return
+		}
+		_, reqPassword, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(reqPassword), []byte(password)) != 1 {
+			if ok {
+				log.Printf(PreError+" http auth rejected from %s, path %s", r.RemoteAddr, r.URL.Path)
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="syncds"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -2,29 +2,21 @@ package main
 
 import (
 	"bytes"
-	"crypto/md5"
 	"encoding/gob"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"github.com/fsnotify/fsnotify"
 	"github.com/gorilla/websocket"
-	"io"
-	"io/ioutil"
 	"log"
 	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
-	"sync"
 	"time"
 )
 
 
 type (
-	Event *fsnotify.Event
-	TimeEventMap map[time.Time]Event
 	WsReqMessage struct {
 		Type string
 		Data []byte
@@ -33,6 +25,21 @@ type (
 		Type string
 		Data string
 	}
+	HelloReq struct {
+		Project   string
+		Signature string
+		Codecs    []string // 支持的压缩算法，按优先级排序
+		Hashes    []string // 支持的hash算法，按优先级排序
+		// 重连时带上收到的最后一行deploy输出，server从这里接着补发
+		LogEpoch int64
+		LastSeq  int64
+	}
+	HelloRes struct {
+		Error    string
+		Codec    string
+		Hash     string
+		LogEpoch int64
+	}
 	DiffReq struct {
 		FileMetas []FileMeta
 	}
@@ -40,252 +47,381 @@ type (
 		FileMetas []FileMeta
 		DeployCmd string
 		DeployKillCmd string
+		HealthChecks []HealthCheck
+		DeploySteps []DeployStep
 	}
 )
 
 
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
 var (
-	clientConf ClientConf
-	messageChan = make(chan WsReqMessage, 10)
 	done = make(chan struct{})
 )
 
 //func main() {
 //	var conf ClientConf
 //	conf.getConf()
-func StartClient(conf ClientConf) {
-	clientConf = conf
-
-	go watch(done)
-	go connectWs(done)
+func StartClient(conf ClientConf, enabledProfiles []string, disabledProfiles []string) {
+	confs, err := conf.profileConfs()
+	if err != nil {
+		log.Fatalf(PreError + " %v", err)
+	}
+	profiles, err := newSyncProfiles(confs, enabledProfiles, disabledProfiles)
+	if err != nil {
+		log.Fatalf(PreError + " %v", err)
+	}
+	for _, p := range profiles {
+		p.start(done)
+	}
 	select {
 	case <-done:
 		log.Printf(PreError + " shutdown! please check and reboot client")
 	}
 }
 
-func watch(done chan struct{}) {
-	refreshDuration := time.Duration(clientConf.IntervalMs) * time.Millisecond
+func (p *syncProfile) watch(done chan struct{}) {
+	quiet := time.Duration(p.conf.IntervalMs) * time.Millisecond
+	maxLatency := time.Duration(p.conf.MaxLatencyMs) * time.Millisecond
 
 	var paths []string
-	for _, includePath := range clientConf.IncludePaths {
-		path := filepath.Join(clientConf.BaseDir, includePath)
+	for _, includePath := range p.conf.IncludePaths {
+		path := filepath.Join(p.conf.BaseDir, includePath)
 		paths = append(paths, path)
 	}
 
 	// 监听base-dir，然后再根据include、exclude筛选
-	rw, err := New(clientConf.BaseDir, func(relativeBasePath string, isDir bool) bool {
-		isMatchExclude, _ := regexp.MatchString(clientConf.ExcludePathRegexp, relativeBasePath)
-		if isMatchExclude {
-			if clientConf.Debug {
-				log.Printf(PreLog + " isMatch %t, isMatchExclude", false)
-			}
-			return false
-		}
-		if !isDir {
-			// baseDir子层
-			if strings.ContainsAny(relativeBasePath, "/\\") {
-				if clientConf.IncludeFileRegexp == "" {
-					return true
-				}
-				isMatchInclude, _ := regexp.MatchString(clientConf.IncludeFileRegexp, relativeBasePath)
-				if clientConf.Debug {
-					log.Printf(PreLog + " isMatch %t, isMatchInclude file", isMatchInclude)
-				}
-				return isMatchInclude
-			}
-			// baseDir这一层，验证匹配includePaths是否有对应文件
-			for _, includePath := range clientConf.IncludePaths {
-				cleanIncludePath := filepath.Clean(includePath);
-				if clientConf.Debug {
-					log.Printf(PreLog + " isMatch %t, isMatchInclude dir", cleanIncludePath == relativeBasePath)
-				}
-				if cleanIncludePath == relativeBasePath {
-					return true
-				}
-			}
-			return false
-		}
-		for _, includePath := range clientConf.IncludePaths {
-			includePath = filepath.Clean(includePath);
-			if strings.HasPrefix(includePath, relativeBasePath) {
-				return true
-			}
-		}
-		if clientConf.Debug {
-			log.Printf(PreLog + " isMatch %t, includePaths dir", false)
-		}
-		return false
-	}, clientConf.Debug)
+	rw, err := New(p.conf.BaseDir, p.isWatchPath, p.conf.Debug)
 	if err != nil {
-		log.Println(PreError, "init rw err:", err)
+		p.log.Println(PreError, "init rw err:", err)
 	}
 	defer rw.Close()
 
-	var mut sync.Mutex
-	events := make(TimeEventMap)
-	baseAbsPath, _ := filepath.Abs(clientConf.BaseDir)
+	baseAbsPath, _ := filepath.Abs(p.conf.BaseDir)
+	agg := newChangeAggregator(p, baseAbsPath, quiet, maxLatency)
 
-	// Collect the events for the last n seconds, repeatedly
 	// Runs in the background
-	CollectFileChangeEvents(rw, &mut, events, done, refreshDuration)
-	log.Printf(PreLog + " start watch at: %s", baseAbsPath)
+	CollectFileChangeEvents(rw, agg, done)
+	p.log.Printf(PreLog + " start watch at: %s, quiet: %v, max latency: %v", baseAbsPath, agg.quiet, agg.maxLatency)
 
-	// Serve events
-	ticker := time.NewTicker(refreshDuration)
+	// Serve events，检查间隔比静默时间短，发送时机更准
+	ticker := time.NewTicker(flushCheckInterval(agg.quiet))
 	defer ticker.Stop()
 	for {
 		select {
 		case <-done:
-			log.Printf(PreError + " watch done")
+			p.log.Printf(PreError + " watch done")
 			return
-		case <-ticker.C:
-			if len(events) == 0 {
-				continue
+		case now := <-ticker.C:
+			fileChanges := agg.Flush(now)
+			// 断线期间先记录改动，重连后随全量对账一起同步
+			if len(fileChanges) > 0 {
+				p.fanOutChanges(fileChanges)
 			}
-			mut.Lock()
-			var fileChanges []FileMeta
-			// Remove old keys
-			RemoveOldEvents(&events, refreshDuration)
-			for _, ev := range events {
-				eventAbsPath, _ := filepath.Abs(ev.Name)
-				filePath := strings.Replace(eventAbsPath, baseAbsPath, "", 1)
-				log.Printf(PreLog + " change filePath: %s, op: %v", filePath, ev.Op)
-				// Avoid sending several events for the same filename
-				existed := false
-				for i := 0; i < len(fileChanges); i++ {
-					if fileChanges[i].FilePath == filePath {
-						existed = true
-						break
-					}
-				}
-				if existed {
-					continue
-				}
-				var optType int
-				if ev.Op == fsnotify.Remove {
-					optType = OptRemove
-				} else {
-					optType = OptWrite
-					fileInfo, err := os.Lstat(ev.Name)
-					if err != nil {
-						log.Println("read file err", filePath)
-					}
-					// 只监听文件，跳过文件夹
-					if err == nil && fileInfo.IsDir() {
-						log.Println(PreLog, "IsDir")
-						continue
-					}
-				}
-				// 同步文件改动
-				fileChanges = append(fileChanges, FileMeta{filePath, optType, "", nil})
+		}
+	}
+}
+
+func flushCheckInterval(quiet time.Duration) time.Duration {
+	interval := quiet / 10
+	if interval < 50*time.Millisecond {
+		interval = 50 * time.Millisecond
+	}
+	return interval
+}
+
+// isWatchPath 根据include-paths、include-file-regexp、exclude-path-regexp判断是否需要监听、同步
+func (p *syncProfile) isWatchPath(relativeBasePath string, isDir bool) bool {
+	isMatchExclude, _ := regexp.MatchString(p.conf.ExcludePathRegexp, relativeBasePath)
+	if isMatchExclude {
+		if p.conf.Debug {
+			p.log.Printf(PreLog + " isMatch %t, isMatchExclude", false)
+		}
+		return false
+	}
+	// include-paths里明确写的路径(如gitignore里的target/xx.jar)不受忽略规则影响
+	if !p.isIncludePathOrParent(relativeBasePath) && p.ignore.Ignored(relativeBasePath, isDir) {
+		if p.conf.Debug {
+			p.log.Printf(PreLog + " isMatch %t, ignored", false)
+		}
+		return false
+	}
+	if !isDir {
+		// baseDir子层
+		if strings.ContainsAny(relativeBasePath, "/\\") {
+			if p.conf.IncludeFileRegexp == "" {
+				return true
 			}
-			if len(fileChanges) > 0 {
-				handleChanges(fileChanges)
+			isMatchInclude, _ := regexp.MatchString(p.conf.IncludeFileRegexp, relativeBasePath)
+			if p.conf.Debug {
+				p.log.Printf(PreLog + " isMatch %t, isMatchInclude file", isMatchInclude)
 			}
-			mut.Unlock()
+			return isMatchInclude
+		}
+		// baseDir这一层，验证匹配includePaths是否有对应文件
+		for _, includePath := range p.conf.IncludePaths {
+			cleanIncludePath := filepath.Clean(includePath);
+			if p.conf.Debug {
+				p.log.Printf(PreLog + " isMatch %t, isMatchInclude dir", cleanIncludePath == relativeBasePath)
+			}
+			if cleanIncludePath == relativeBasePath {
+				return true
+			}
+		}
+		return false
+	}
+	for _, includePath := range p.conf.IncludePaths {
+		includePath = filepath.Clean(includePath);
+		if strings.HasPrefix(includePath, relativeBasePath) {
+			return true
+		}
+		// include-paths下的子目录，新建、改名、删除都要跟着同步
+		if strings.HasPrefix(relativeBasePath, includePath + string(filepath.Separator)) {
+			return true
+		}
+	}
+	if p.conf.Debug {
+		p.log.Printf(PreLog + " isMatch %t, includePaths dir", false)
+	}
+	return false
+}
+
+func (p *syncProfile) isIncludePathOrParent(relativeBasePath string) bool {
+	for _, includePath := range p.conf.IncludePaths {
+		includePath = filepath.Clean(includePath)
+		if includePath == relativeBasePath || strings.HasPrefix(includePath, relativeBasePath + string(filepath.Separator)) {
+			return true
 		}
 	}
+	return false
 }
 
-func handleChanges(fileChanges []FileMeta) {
+func (t *syncTarget) handleChanges(fileChanges []FileMeta) {
+	t.connMut.Lock()
+	algo := t.hashAlgo
+	t.connMut.Unlock()
 	var filePaths []string
-	for index, fileMeta := range fileChanges{
-		if fileMeta.OptType == OptRemove {
+	kept := fileChanges[:0]
+	for _, fileMeta := range fileChanges{
+		if fileMeta.OptType != OptWrite {
+			kept = append(kept, fileMeta)
 			continue
 		}
-		file, err := os.Open(filepath.Join(clientConf.BaseDir, fileMeta.FilePath))
-		if err != nil {
-			log.Println("file open err", err)
+		err := t.profile.fillFileMeta(&fileMeta, algo)
+		if os.IsNotExist(err) {
+			// 发送前又被删了，删除事件会在下一批同步
+			t.log.Printf(PreLog + " %s removed before sync, dropped", fileMeta.FilePath)
 			continue
 		}
-		md5hash := md5.New()
-		_, err = io.Copy(md5hash, file)
-		_ = file.Close()
 		if err != nil {
-			log.Println("file copy err", err)
-			continue
+			t.log.Println("file read err", err)
 		}
-		md5Code := hex.EncodeToString(md5hash.Sum(nil))
-		fileMeta.Md5Code = md5Code
-		fileChanges[index] = fileMeta
+		kept = append(kept, fileMeta)
 		filePaths = append(filePaths, fileMeta.FilePath)
 	}
+	fileChanges = kept
 
-	log.Printf(PreLog + " diff files: %v", filePaths)
+	t.log.Printf(PreLog + " diff files: %v", filePaths)
+	t.sendDiff(fileChanges)
+}
+
+func (t *syncTarget) sendDiff(fileChanges []FileMeta) {
 	req := DiffReq {
 		fileChanges,
 	}
+	t.setStatus(targetSyncing, "", false)
+	t.sendWsReq("diff", req)
+}
 
+// sendWsReq gob编码后放入发送队列
+func (t *syncTarget) sendWsReq(typ string, req interface{}) {
 	buf := &bytes.Buffer{}
-	_ = gob.NewEncoder(buf).Encode(req)
-	wsMsg := WsReqMessage{
-		"diff",
+	err := gob.NewEncoder(buf).Encode(req)
+	if err != nil {
+		t.log.Printf("gob Encode %s err %v", typ, err)
+		return
+	}
+	t.messageChan <- WsReqMessage{
+		typ,
 		buf.Bytes(),
 	}
-
-	messageChan <- wsMsg
 }
 
-func syncChanges(fileChanges []FileMeta) {
-	deployCmd := ""
+func (t *syncTarget) syncChanges(fileChanges []FileMeta) {
+	// 同一时间只跑一批同步，避免同一文件的分片交错
+	t.syncMut.Lock()
+	defer t.syncMut.Unlock()
+
+	conf := t.profile.conf
+	// 配了deploy-cmd或deploy-steps才会deploy
+	deployable := conf.DeployCmd != "" || len(conf.DeploySteps) > 0
+	deploy := false
 	var filePaths []string
-	for index, fileMeta := range fileChanges {
+	for _, fileMeta := range fileChanges {
 		filePaths = append(filePaths, fileMeta.FilePath)
+	}
+	t.log.Printf(PreLog + " sync begin, plz wait, files: %v", filePaths)
+
+	// server把旧路径不存在的rename改成了写入，这时才读文件信息
+	t.connMut.Lock()
+	algo := t.hashAlgo
+	t.connMut.Unlock()
+	for i := range fileChanges {
+		if fileChanges[i].OptType == OptWrite && fileChanges[i].Hash == "" {
+			if err := t.profile.fillFileMeta(&fileChanges[i], algo); err != nil {
+				t.log.Printf(PreError + " read %s err: %v", fileChanges[i].FilePath, err)
+			}
+		}
+	}
+
+	// 逐个文件分片上传，不再把所有文件塞进一条消息
+	results := t.streamFiles(fileChanges)
+	var syncedChanges []FileMeta
+	var failedChanges []FileMeta
+	var rawBytes, sentBytes int64
+	for _, fileMeta := range fileChanges {
+		fileMeta.Signature = nil
 		if fileMeta.OptType == OptRemove {
+			syncedChanges = append(syncedChanges, fileMeta)
 			continue
 		}
-		filename := filepath.Join(clientConf.BaseDir, fileMeta.FilePath)
-		fileData, err := ioutil.ReadFile(filename)
-		if err != nil {
-			log.Println("file open err", err)
+		result := results[fileMeta.FilePath]
+		if result.Err != nil {
+			t.log.Printf(PreError + " sync file %s failed, err: %v", fileMeta.FilePath, result.Err)
+			failedChanges = append(failedChanges, fileMeta)
 			continue
 		}
-		fileMeta.FileData = fileData
-		fileChanges[index] = fileMeta
-		// 是否触发deploy-cmd
-		if clientConf.DeployPathRegexp != "" {
-			isMatch, _ := regexp.MatchString(clientConf.DeployPathRegexp, fileMeta.FilePath)
+		rawBytes += result.RawBytes
+		sentBytes += result.SentBytes
+		syncedChanges = append(syncedChanges, fileMeta)
+		// 是否触发deploy
+		if conf.DeployPathRegexp != "" {
+			isMatch, _ := regexp.MatchString(conf.DeployPathRegexp, fileMeta.FilePath)
 			if isMatch {
-				deployCmd = clientConf.DeployCmd
+				deploy = deployable
 			}
 		} else {
-			deployCmd = clientConf.DeployCmd
+			deploy = deployable
 		}
 	}
+	// 上传失败的文件稍后重试
+	t.scheduleRetry(failedChanges)
+	if len(syncedChanges) == 0 {
+		t.setStatus(targetFailed, fmt.Sprintf("%d files upload failed", len(failedChanges)), true)
+		return
+	}
 
-	log.Printf(PreLog + " sync begin, plz wait, files: %v, deploy? %t", filePaths, len(deployCmd) > 0)
-	req := SyncReq {
-		fileChanges,
-		deployCmd,
-		clientConf.DeployKillCmd,
+	ratio := 100.0
+	if rawBytes > 0 {
+		ratio = float64(sentBytes) * 100 / float64(rawBytes)
 	}
-	buf := &bytes.Buffer{}
-	_ = gob.NewEncoder(buf).Encode(req)
-	wsMsg := WsReqMessage{
-		"sync",
-		buf.Bytes(),
+	t.log.Printf(PreLog + " sync %d files done, %s -> %s (%.1f%%), deploy? %t", len(syncedChanges), FormatFileSize(rawBytes), FormatFileSize(sentBytes), ratio, deploy)
+	req := SyncReq{FileMetas: syncedChanges}
+	if deploy {
+		req.DeployCmd = conf.DeployCmd
+		req.DeployKillCmd = conf.DeployKillCmd
+		req.HealthChecks = conf.HealthChecks
+		req.DeploySteps = conf.DeploySteps
+	}
+	t.retryMut.Lock()
+	for _, fileMeta := range syncedChanges {
+		t.syncingMetas[fileMeta.FilePath] = fileMeta
+	}
+	t.retryMut.Unlock()
+	t.sendWsReq("sync", req)
+}
+
+func (t *syncTarget) connectWs(done chan struct{}) {
+	u := t.serverUrl()
+	dialer := *websocket.DefaultDialer
+	if u.Scheme == "wss" {
+		dialer.TLSClientConfig = pinnedTlsConfig(t.tlsFingerprint)
+	}
+	delay := minReconnectDelay
+	for {
+		c, _, err := dialer.Dial(u.String(), nil)
+		if err != nil {
+			t.log.Printf(PreError + " dial %s failed, retry in %v, err: %v", u.String(), delay, err)
+			select {
+			case <-done:
+				return
+			case <-time.After(delay):
+			}
+			// 指数退避
+			delay *= 2
+			if delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+			continue
+		}
+		delay = minReconnectDelay
+		if !t.serveConn(c, done) {
+			return
+		}
+		t.log.Printf(PreError + " lost connection to server %s, reconnecting", t.server)
 	}
+}
 
-	messageChan <- wsMsg
+// serverUrl server支持写成ws://、wss://开头，或者配置tls: true
+func (t *syncTarget) serverUrl() url.URL {
+	scheme := "ws"
+	host := t.server
+	if strings.HasPrefix(host, "wss://") {
+		scheme = "wss"
+	}
+	host = strings.TrimPrefix(strings.TrimPrefix(host, "wss://"), "ws://")
+	if t.tls {
+		scheme = "wss"
+	}
+	return url.URL{Scheme: scheme, Host: strings.TrimSuffix(host, "/"), Path: "/ws"}
 }
 
-func connectWs(done chan struct{}) {
-	u := url.URL{Scheme: "ws", Host: clientConf.Server, Path: "/ws"}
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+// serveConn 处理一条ws连接直到断开，返回false表示不再重连：client已退出或server拒绝了认证
+func (t *syncTarget) serveConn(c *websocket.Conn, done chan struct{}) bool {
+	defer c.Close()
+	helloRes, err := t.clientHandshake(c)
 	if err != nil {
-		log.Fatal("dial:", err)
+		if _, ok := err.(errAuthRejected); ok {
+			// 配置不对重连也没用，只停掉这台server，其它server照常同步
+			t.log.Printf(PreError + " %v, please check the secret and hash in %s, stop syncing to %s", err, fileNameClientConfig, t.server)
+			t.connMut.Lock()
+			t.rejected = true
+			t.connMut.Unlock()
+			t.setStatus(targetFailed, err.Error(), true)
+			return false
+		}
+		t.log.Printf(PreError + " handshake with server failed, err: %v", err)
+		return true
 	}
-	defer c.Close()
-	_ = c.WriteMessage(websocket.TextMessage, []byte("set up connection from client"));
-	log.Printf(PreLog + " start ws connection to server at: %s", clientConf.Server)
+	t.log.Printf(PreLog + " start ws connection to server at: %s, compress: %s, hash: %s", t.server, helloRes.Codec, helloRes.Hash)
 
+	t.connMut.Lock()
+	t.codec = helloRes.Codec
+	t.hashAlgo = helloRes.Hash
+	if t.logEpoch != helloRes.LogEpoch {
+		// server重启过，序号重新开始
+		t.logEpoch = helloRes.LogEpoch
+		t.lastDeploySeq = 0
+	}
+	t.connMut.Unlock()
+	defer func() {
+		t.connMut.Lock()
+		t.online = false
+		t.connMut.Unlock()
+		t.setStatus(targetOffline, "", true)
+	}()
+	go t.reconcile()
+
+	connDone := make(chan struct{})
 	go func() {
+		defer close(connDone)
 		for {
 			_, message, err := c.ReadMessage()
 			if err != nil {
-				log.Printf(PreError + " read message from server failed, err: %v", err)
-				done <- struct{}{}
+				t.log.Printf(PreError + " read message from server failed, err: %v", err)
 				return
 			}
 			var wsResMsg WsResMessage
@@ -296,17 +432,70 @@ func connectWs(done chan struct{}) {
 				var fileMetas []FileMeta
 				_ = json.Unmarshal([]byte(data), &fileMetas)
 				if len(fileMetas) > 0 {
-					syncChanges(fileMetas)
+					// 上传要等chunkAck，不能阻塞读协程
+					go t.syncChanges(fileMetas)
 				} else {
-					log.Printf(PreLog + " no diff, skiped all changed fileds")
+					t.log.Printf(PreLog + " no diff, skiped all changed fileds")
+					t.setStatus(targetUpToDate, "", true)
 				}
+			case "chunkAck":
+				dispatchChunkAck(wsResMsg.Data)
+			case "manifestRes":
+				dispatchManifestRes(wsResMsg.Data)
 			case "syncRes":
-				data := wsResMsg.Data
-				log.Printf(PreLog + " syncRes %s", data)
-			case "deployStdout":
-				fmt.Printf("[stdout] %s\n", wsResMsg.Data)
-			case "deployStderr":
-				fmt.Printf("[stderr] %s\n", wsResMsg.Data)
+				go t.handleSyncRes(wsResMsg.Data)
+			case "deployRes":
+				t.log.Printf(PreLog + " deployRes %s", wsResMsg.Data)
+				t.setDeployStatus(wsResMsg.Data)
+				// 启动成功、失败时汇总一次
+				if strings.HasPrefix(wsResMsg.Data, "cmd ") {
+					t.profile.printSummary()
+				}
+			case "deployLog":
+				line := DeployLine{}
+				err = json.Unmarshal([]byte(wsResMsg.Data), &line)
+				if err != nil {
+					t.log.Printf(PreError+" read deployLog err: %v", err)
+					continue
+				}
+				t.setLastDeploySeq(line.Seq)
+				tag := line.Stream
+				if line.Step != "" {
+					tag = line.Step + "/" + line.Stream
+				}
+				fmt.Printf("%s%s [%s] %s\n", t.log.Prefix(), line.Time.Local().Format(deployTimeFormat), tag, line.Text)
+			case "deployStep":
+				res := DeployStepRes{}
+				err = json.Unmarshal([]byte(wsResMsg.Data), &res)
+				if err != nil {
+					t.log.Printf(PreError+" read deployStep err: %v", err)
+					continue
+				}
+				t.printDeployStep(res)
+			case "pipelineRes":
+				res := PipelineRes{}
+				err = json.Unmarshal([]byte(wsResMsg.Data), &res)
+				if err != nil {
+					t.log.Printf(PreError+" read pipelineRes err: %v", err)
+					continue
+				}
+				t.printPipelineRes(res)
+			case "healthRes":
+				res := HealthRes{}
+				err = json.Unmarshal([]byte(wsResMsg.Data), &res)
+				if err != nil {
+					t.log.Printf(PreError+" read healthRes err: %v", err)
+					continue
+				}
+				t.printHealthRes(res)
+			case "deployReplay":
+				replay := DeployReplay{}
+				_ = json.Unmarshal([]byte(wsResMsg.Data), &replay)
+				if replay.Missed > 0 {
+					t.log.Printf(PreLog+" replay %d lines of deploy output, %d lines missed", replay.Count, replay.Missed)
+				} else {
+					t.log.Printf(PreLog+" replay %d lines of deploy output", replay.Count)
+				}
 			}
 		}
 	}()
@@ -315,23 +504,105 @@ func connectWs(done chan struct{}) {
 		select {
 		case <-done:
 			_ = c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "done"))
-			return
-		case wsMsg := <-messageChan:
+			return false
+		case <-connDone:
+			return true
+		case wsMsg := <-t.messageChan:
 			buf := &bytes.Buffer{}
-			err = gob.NewEncoder(buf).Encode(wsMsg)
+			err := gob.NewEncoder(buf).Encode(wsMsg)
 			if err != nil {
-				log.Printf("binary Encode err %v", err)
+				t.log.Printf("binary Encode err %v", err)
 			}
 			err = c.WriteMessage(websocket.BinaryMessage, buf.Bytes())
 			if err != nil {
-				log.Println("write:", err)
-				return
+				t.log.Println("write:", err)
+				// 关闭连接让读协程退出，随后重连
+				_ = c.Close()
+				<-connDone
+				return true
 			}
 		}
 	}
 }
 
-func CollectFileChangeEvents(watcher *ReWatcher, mut *sync.Mutex, events TimeEventMap, done chan struct{}, maxAge time.Duration) {
+// recordOfflineChanges 断线时记录改动，返回false表示在线、需要直接同步
+func (t *syncTarget) recordOfflineChanges(fileChanges []FileMeta) bool {
+	t.connMut.Lock()
+	defer t.connMut.Unlock()
+	if t.online {
+		return false
+	}
+	if t.rejected {
+		// 不会再连接，改动不用记
+		return true
+	}
+	for _, fileMeta := range fileChanges {
+		switch fileMeta.OptType {
+		case OptMkdir:
+			// 目录下的文件对账时会扫到
+			continue
+		case OptRename:
+			// 新路径对账时会扫到，只需要记下旧路径被删
+			oldMeta := FileMeta{FilePath: fileMeta.OldPath, OptType: OptRemove}
+			if isDir(filepath.Join(t.profile.conf.BaseDir, fileMeta.FilePath)) {
+				oldMeta.OptType = OptRemoveDir
+			}
+			t.offlineChanges[oldMeta.FilePath] = oldMeta
+			continue
+		}
+		t.offlineChanges[fileMeta.FilePath] = fileMeta
+	}
+	t.log.Printf(PreLog + " offline, %d changes recorded, will sync after reconnect", len(t.offlineChanges))
+	t.status, t.statusDetail = targetOffline, fmt.Sprintf("%d changes pending", len(t.offlineChanges))
+	return true
+}
+
+// reconcile 连上server后先全量对账include-paths，把断线、未启动期间的改动补上，之后才实时同步
+func (t *syncTarget) reconcile() {
+	t.connMut.Lock()
+	pending := t.offlineChanges
+	t.offlineChanges = make(map[string]FileMeta)
+	t.online = true
+	t.status, t.statusDetail = targetSyncing, ""
+	algo := t.hashAlgo
+	t.connMut.Unlock()
+
+	start := time.Now()
+	fileMetas, err := t.profile.buildManifest(algo)
+	if err != nil {
+		t.log.Println(PreError, "build manifest err:", err)
+	}
+	for _, fileMeta := range fileMetas {
+		delete(pending, fileMeta.FilePath)
+	}
+	t.log.Printf(PreLog + " reconcile %d files, manifest built in %v", len(fileMetas), time.Since(start))
+	// 先按目录hash比较，只把不一致的文件送去diff
+	fileChanges, err := t.compareWithServer(fileMetas)
+	if err != nil {
+		t.log.Printf(PreError + " merkle compare failed, diff all files, err: %v", err)
+		fileChanges = fileMetas
+	}
+	// 清单已覆盖仍存在的文件，剩下的就是期间删掉的
+	for _, fileMeta := range pending {
+		if fileMeta.OptType == OptRemoveDir {
+			// 删掉后又建了同名目录
+			if isDir(filepath.Join(t.profile.conf.BaseDir, fileMeta.FilePath)) {
+				continue
+			}
+		} else {
+			fileMeta.OptType = OptRemove
+		}
+		fileChanges = append(fileChanges, fileMeta)
+	}
+	if len(fileChanges) > 0 {
+		t.sendDiff(fileChanges)
+	} else {
+		t.setStatus(targetUpToDate, "", true)
+	}
+}
+
+// CollectFileChangeEvents 后台把监听事件交给aggregator合并
+func CollectFileChangeEvents(watcher *ReWatcher, agg *changeAggregator, done chan struct{}) {
 	go func() {
 		for {
 			select {
@@ -345,21 +616,8 @@ func CollectFileChangeEvents(watcher *ReWatcher, mut *sync.Mutex, events TimeEve
 					log.Println(PreError, "watch err:", ev.Error)
 					continue
 				}
-				mut.Lock()
-				RemoveOldEvents(&events, maxAge)
-				events[time.Now()] = Event(ev.Body)
-				mut.Unlock()
+				agg.Add(ev)
 			}
 		}
 	}()
 }
-
-func RemoveOldEvents(events *TimeEventMap, maxAge time.Duration) {
-	now := time.Now()
-	longTimeAgo := now.Add(-maxAge)
-	for t := range *events {
-		if t.Before(longTimeAgo) {
-			delete(*events, t)
-		}
-	}
-}
\ No newline at end of file
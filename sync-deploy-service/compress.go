@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CodecNone = "none"
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+)
+
+// 默认按这个顺序协商
+var defaultCodecs = []string{CodecZstd, CodecGzip}
+
+// 本身已经压缩过的文件，再压缩只是浪费cpu
+var compressedExts = map[string]bool{
+	".jar": true, ".war": true, ".ear": true, ".zip": true, ".gz": true, ".tgz": true,
+	".bz2": true, ".xz": true, ".zst": true, ".7z": true, ".rar": true,
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true,
+	".mp3": true, ".mp4": true, ".woff": true, ".woff2": true,
+}
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(chunkSize*2))
+)
+
+func isSupportedCodec(codec string) bool {
+	return codec == CodecGzip || codec == CodecZstd
+}
+
+// negotiateCodec 按client的优先级，选出第一个server也允许的压缩算法
+func negotiateCodec(clientCodecs []string, serverCodecs []string) string {
+	if len(serverCodecs) == 0 {
+		serverCodecs = defaultCodecs
+	}
+	for _, codec := range clientCodecs {
+		if !isSupportedCodec(codec) {
+			continue
+		}
+		for _, allowed := range serverCodecs {
+			if allowed == codec {
+				return codec
+			}
+		}
+	}
+	return CodecNone
+}
+
+func shouldCompress(filePath string) bool {
+	return !compressedExts[strings.ToLower(filepath.Ext(filePath))]
+}
+
+func compressChunk(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case CodecZstd:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	case CodecGzip:
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unsupported codec %s", codec)
+}
+
+// decompressChunk 解压后不会超过一片的大小，多出来的直接报错，防止压缩炸弹
+func decompressChunk(codec string, data []byte) ([]byte, error) {
+	var out []byte
+	var err error
+	switch codec {
+	case CodecZstd:
+		out, err = zstdDecoder.DecodeAll(data, nil)
+	case CodecGzip:
+		var r *gzip.Reader
+		r, err = gzip.NewReader(bytes.NewReader(data))
+		if err == nil {
+			out, err = ioutil.ReadAll(io.LimitReader(r, chunkSize+1))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported codec %s", codec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > chunkSize {
+		return nil, fmt.Errorf("decompressed chunk larger than %d", chunkSize)
+	}
+	return out, nil
+}
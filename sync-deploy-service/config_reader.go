@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"log"
@@ -13,16 +14,41 @@ const (
 
 type ClientConf struct {
 	Name              string   `yaml:"name"`
+	Project           string   `yaml:"project"`
 	Server            string   `yaml:"server"`
+	Servers           []ServerTarget `yaml:"servers"`
 	BaseDir           string   `yaml:"base-dir"`
 	IntervalMs        int      `yaml:"interval-ms"`
+	MaxLatencyMs      int      `yaml:"max-latency-ms"`
 	IncludePaths      []string `yaml:"include-paths"`
 	IncludeFileRegexp string   `yaml:"include-file-regexp"`
 	ExcludePathRegexp string   `yaml:"exclude-path-regexp"`
+	UseGitignore      bool     `yaml:"use-gitignore"`
 	DeployPathRegexp  string   `yaml:"deploy-path-regexp"`
 	DeployCmd         string   `yaml:"deploy-cmd"`
 	DeployKillCmd     string   `yaml:"deploy-kill-cmd"`
+	HealthChecks      []HealthCheck `yaml:"health-checks"`
+	DeploySteps       []DeployStep `yaml:"deploy-steps"`
+	Secret            string   `yaml:"secret"`
+	Tls               bool     `yaml:"tls"`
+	TlsFingerprint    string   `yaml:"tls-fingerprint"`
+	Compress          []string `yaml:"compress"`
+	SkipAttrs         []string `yaml:"skip-attrs"`
+	Hash              []string `yaml:"hash"`
 	Debug             bool   `yaml:"debug"`
+	// 多个profile时每个profile是一份完整配置，没填的项沿用外层
+	Profiles          []yaml.MapSlice `yaml:"profiles"`
+	Disabled          bool   `yaml:"disabled"`
+}
+
+// ServerTarget 同时同步的多台server之一，project、secret、tls-fingerprint不填时用外层的
+type ServerTarget struct {
+	Name           string `yaml:"name"`
+	Server         string `yaml:"server"`
+	Project        string `yaml:"project"`
+	Secret         string `yaml:"secret"`
+	Tls            bool   `yaml:"tls"`
+	TlsFingerprint string `yaml:"tls-fingerprint"`
 }
 
 func (conf *ClientConf) getConf() *ClientConf {
@@ -37,12 +63,75 @@ func (conf *ClientConf) getConf() *ClientConf {
 	return conf
 }
 
+// profileConfs 没配profiles时就是外层这一份；profile的name也是连接server时的项目名
+func (conf *ClientConf) profileConfs() ([]ClientConf, error) {
+	if len(conf.Profiles) == 0 {
+		return []ClientConf{*conf}, nil
+	}
+	var confs []ClientConf
+	names := make(map[string]bool)
+	for index, item := range conf.Profiles {
+		profileConf := *conf
+		profileConf.Name = ""
+		profileConf.Profiles = nil
+		profileConf.Disabled = false
+		data, err := yaml.Marshal(item)
+		if err != nil {
+			return nil, err
+		}
+		err = yaml.Unmarshal(data, &profileConf)
+		if err != nil {
+			return nil, fmt.Errorf("profile %d unmarshal err %v", index+1, err)
+		}
+		if profileConf.Name == "" {
+			return nil, fmt.Errorf("profile %d has no name", index+1)
+		}
+		if names[profileConf.Name] {
+			return nil, fmt.Errorf("duplicated profile name `%s`", profileConf.Name)
+		}
+		names[profileConf.Name] = true
+		confs = append(confs, profileConf)
+	}
+	return confs, nil
+}
+
 
 type ServerConf struct {
 	Name string `yaml:"name"`
 	Server string `yaml:"server"`
 	BaseDir string `yaml:"base-dir"`
 	ShowDirList bool `yaml:"show-dir-list"`
+	Secret string `yaml:"secret"`
+	HttpPassword string `yaml:"http-password"`
+	Tls bool `yaml:"tls"`
+	TlsCertFile string `yaml:"tls-cert-file"`
+	TlsKeyFile string `yaml:"tls-key-file"`
+	Compress []string `yaml:"compress"`
+	HashCacheSize int `yaml:"hash-cache-size"`
+	SkipAttrs []string `yaml:"skip-attrs"`
+	ProtectedPaths []string `yaml:"protected-paths"`
+	Hash []string `yaml:"hash"`
+	DeployCmds []string `yaml:"deploy-cmds"`
+	HealthChecks []HealthCheck `yaml:"health-checks"`
+	StopGraceMs int `yaml:"stop-grace-ms"`
+	DeployPorts []int `yaml:"deploy-ports"`
+	DeployLogLines int `yaml:"deploy-log-lines"`
+	DeployLogReplay int `yaml:"deploy-log-replay"`
+	// 配置后client握手时必须指定其中一个项目
+	Projects []ServerProjectConf `yaml:"projects"`
+}
+
+// ServerProjectConf server上的一个项目，secret、http-password、stop-grace-ms不填时用外层的，protected-paths在外层的基础上追加
+type ServerProjectConf struct {
+	Name string `yaml:"name"`
+	BaseDir string `yaml:"base-dir"`
+	Secret string `yaml:"secret"`
+	HttpPassword string `yaml:"http-password"`
+	DeployCmds []string `yaml:"deploy-cmds"`
+	HealthChecks []HealthCheck `yaml:"health-checks"`
+	ProtectedPaths []string `yaml:"protected-paths"`
+	StopGraceMs int `yaml:"stop-grace-ms"`
+	DeployPorts []int `yaml:"deploy-ports"`
 }
 
 func (conf *ServerConf) getConf() *ServerConf {
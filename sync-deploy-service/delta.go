@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+)
+
+const (
+	// 小文件直接全量传
+	deltaMinFileSize = 64 * 1024
+	minBlockSize     = 2 * 1024
+	maxBlockSize     = 64 * 1024
+	maxLiteralSize   = 64 * 1024
+
+	deltaOpCopy    = 'C'
+	deltaOpLiteral = 'L'
+)
+
+type (
+	// DeltaSignature server端旧文件的分块签名，client据此只发送变化的块
+	DeltaSignature struct {
+		BlockSize int
+		Size      int64
+		Hash      string // 强校验用的hash算法，与整个文件的hash一致
+		Blocks    []BlockSignature
+	}
+	BlockSignature struct {
+		Weak   uint32
+		Strong []byte
+	}
+)
+
+// rollingSum rsync的弱校验，窗口滑动一个字节时可以O(1)更新
+type rollingSum struct {
+	a, b uint32
+	size uint32
+}
+
+func newRollingSum(block []byte) rollingSum {
+	r := rollingSum{size: uint32(len(block))}
+	for i, c := range block {
+		r.a += uint32(c)
+		r.b += uint32(len(block)-i) * uint32(c)
+	}
+	return r
+}
+
+func (r *rollingSum) roll(out byte, in byte) {
+	r.a = r.a - uint32(out) + uint32(in)
+	r.b = r.b - r.size*uint32(out) + r.a
+}
+
+func (r rollingSum) sum() uint32 {
+	return (r.a & 0xffff) | (r.b << 16)
+}
+
+func strongSum(algo string, block []byte) []byte {
+	hasher := newHasher(algo)
+	hasher.Write(block)
+	return hasher.Sum(nil)
+}
+
+func deltaBlockSize(size int64) int {
+	blockSize := int(math.Sqrt(float64(size))) / 1024 * 1024
+	if blockSize < minBlockSize {
+		return minBlockSize
+	}
+	if blockSize > maxBlockSize {
+		return maxBlockSize
+	}
+	return blockSize
+}
+
+// calcSignature server端计算已有文件的分块签名
+func calcSignature(algo string, filePath string) (*DeltaSignature, error) {
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sig := &DeltaSignature{
+		BlockSize: deltaBlockSize(stat.Size()),
+		Size:      stat.Size(),
+		Hash:      algo,
+	}
+	buf := make([]byte, sig.BlockSize)
+	for {
+		n, err := io.ReadFull(file, buf)
+		if n > 0 {
+			sig.Blocks = append(sig.Blocks, BlockSignature{
+				newRollingSum(buf[:n]).sum(),
+				strongSum(algo, buf[:n]),
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// deltaWriter 把copy、literal操作编码写到临时文件
+type deltaWriter struct {
+	w            *bufio.Writer
+	literal      []byte
+	literalBytes int64
+}
+
+func (d *deltaWriter) writeCopy(index int) error {
+	if err := d.flushLiteral(); err != nil {
+		return err
+	}
+	buf := make([]byte, binary.MaxVarintLen64+1)
+	buf[0] = deltaOpCopy
+	n := binary.PutUvarint(buf[1:], uint64(index))
+	_, err := d.w.Write(buf[:n+1])
+	return err
+}
+
+func (d *deltaWriter) writeLiteral(c byte) error {
+	d.literal = append(d.literal, c)
+	if len(d.literal) >= maxLiteralSize {
+		return d.flushLiteral()
+	}
+	return nil
+}
+
+func (d *deltaWriter) flushLiteral() error {
+	if len(d.literal) == 0 {
+		return nil
+	}
+	buf := make([]byte, binary.MaxVarintLen64+1)
+	buf[0] = deltaOpLiteral
+	n := binary.PutUvarint(buf[1:], uint64(len(d.literal)))
+	if _, err := d.w.Write(buf[:n+1]); err != nil {
+		return err
+	}
+	if _, err := d.w.Write(d.literal); err != nil {
+		return err
+	}
+	d.literalBytes += int64(len(d.literal))
+	d.literal = d.literal[:0]
+	return nil
+}
+
+// buildDelta client端对照server的签名生成增量文件，返回增量临时文件、新文件hash、literal字节数
+func buildDelta(filePath string, sig *DeltaSignature) (string, string, int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer file.Close()
+	tmpFile, err := ioutil.TempFile("", "syncds-delta-")
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer tmpFile.Close()
+
+	hashCode, literalBytes, err := writeDelta(file, sig, tmpFile)
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return "", "", 0, err
+	}
+	return tmpFile.Name(), hashCode, literalBytes, nil
+}
+
+func writeDelta(file io.Reader, sig *DeltaSignature, out io.Writer) (string, int64, error) {
+	blockSize := sig.BlockSize
+	if blockSize <= 0 {
+		return "", 0, fmt.Errorf("invalid block size %d", blockSize)
+	}
+	// 最后一块可能不足blockSize，只在文件末尾比对
+	fullBlocks := make(map[uint32][]int)
+	lastIndex := -1
+	for i, block := range sig.Blocks {
+		if int64(i+1)*int64(blockSize) <= sig.Size {
+			fullBlocks[block.Weak] = append(fullBlocks[block.Weak], i)
+		} else {
+			lastIndex = i
+		}
+	}
+
+	hasher := newHasher(sig.Hash)
+	reader := bufio.NewReaderSize(io.TeeReader(file, hasher), 1024*1024)
+	d := &deltaWriter{w: bufio.NewWriter(out)}
+
+	// 环形窗口
+	window := make([]byte, blockSize)
+	contiguous := make([]byte, blockSize)
+	start, n := 0, 0
+	fill := func() error {
+		start = 0
+		var err error
+		n, err = io.ReadFull(reader, window)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		return err
+	}
+	windowBytes := func() []byte {
+		copy(contiguous, window[start:n])
+		copy(contiguous[n-start:], window[:start])
+		return contiguous[:n]
+	}
+
+	if err := fill(); err != nil {
+		return "", 0, err
+	}
+	rolling := newRollingSum(window[:n])
+	for n == blockSize {
+		matched := -1
+		if candidates, ok := fullBlocks[rolling.sum()]; ok {
+			strong := strongSum(sig.Hash, windowBytes())
+			for _, index := range candidates {
+				if bytes.Equal(strong, sig.Blocks[index].Strong) {
+					matched = index
+					break
+				}
+			}
+		}
+		if matched >= 0 {
+			if err := d.writeCopy(matched); err != nil {
+				return "", 0, err
+			}
+			if err := fill(); err != nil {
+				return "", 0, err
+			}
+			rolling = newRollingSum(window[:n])
+			continue
+		}
+
+		out := window[start]
+		if err := d.writeLiteral(out); err != nil {
+			return "", 0, err
+		}
+		in, err := reader.ReadByte()
+		if err == io.EOF {
+			// 剩下不足一块，转成线性排列后按尾块处理
+			copy(window, windowBytes()[1:])
+			start, n = 0, n-1
+			break
+		}
+		if err != nil {
+			return "", 0, err
+		}
+		window[start] = in
+		start = (start + 1) % blockSize
+		rolling.roll(out, in)
+	}
+
+	tail := windowBytes()
+	if len(tail) > 0 && lastIndex >= 0 && int64(len(tail)) == sig.Size-int64(lastIndex)*int64(blockSize) &&
+		bytes.Equal(strongSum(sig.Hash, tail), sig.Blocks[lastIndex].Strong) {
+		if err := d.writeCopy(lastIndex); err != nil {
+			return "", 0, err
+		}
+	} else {
+		for _, c := range tail {
+			if err := d.writeLiteral(c); err != nil {
+				return "", 0, err
+			}
+		}
+	}
+	if err := d.flushLiteral(); err != nil {
+		return "", 0, err
+	}
+	if err := d.w.Flush(); err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), d.literalBytes, nil
+}
+
+// applyDelta server端用旧文件和增量还原新文件，返回新文件的hash
+func applyDelta(algo string, basePath string, deltaPath string, outPath string, blockSize int, baseSize int64) (string, error) {
+	base, err := os.Open(basePath)
+	if err != nil {
+		return "", err
+	}
+	defer base.Close()
+	stat, err := base.Stat()
+	if err != nil {
+		return "", err
+	}
+	// 算签名之后旧文件又被改过，块对不上了
+	if stat.Size() != baseSize || blockSize <= 0 {
+		return "", fmt.Errorf("base file changed since diff, expect size %d, got %d", baseSize, stat.Size())
+	}
+	deltaFile, err := os.Open(deltaPath)
+	if err != nil {
+		return "", err
+	}
+	defer deltaFile.Close()
+	out, err := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	hasher := newHasher(algo)
+	writer := bufio.NewWriter(io.MultiWriter(out, hasher))
+	reader := bufio.NewReader(deltaFile)
+	block := make([]byte, blockSize)
+	for {
+		op, err := reader.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		arg, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return "", err
+		}
+		switch op {
+		case deltaOpCopy:
+			offset := int64(arg) * int64(blockSize)
+			if offset >= baseSize {
+				return "", fmt.Errorf("copy block %d out of range", arg)
+			}
+			n, err := base.ReadAt(block, offset)
+			if err != nil && err != io.EOF {
+				return "", err
+			}
+			if _, err := writer.Write(block[:n]); err != nil {
+				return "", err
+			}
+		case deltaOpLiteral:
+			if _, err := io.CopyN(writer, reader, int64(arg)); err != nil {
+				return "", err
+			}
+		default:
+			return "", fmt.Errorf("unknown delta op %c", op)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+	// 超长的一行按这个长度拆开，不能因为一行太长停止读取，否则进程写满管道会卡住
+	maxDeployLineSize = 64 * 1024
+	deployTimeFormat  = "15:04:05.000"
+	// 每个项目保留的deploy输出行数
+	defaultDeployLogLines = 1000
+	// 新连上的client补发最近多少行
+	defaultDeployLogReplay = 100
+)
+
+// DeployLine deploy命令输出的一行，Seq是项目内的序号，stdout、stderr按server读到的先后编号
+type DeployLine struct {
+	Seq    int64
+	Time   time.Time
+	Step   string // 流水线的步骤名，只有deploy-cmd时为空
+	Stream string
+	Text   string
+}
+
+// readDeployOutput 同时读stdout、stderr，每读到一行调用一次emit，emit不会并发调用；两个都读完才返回
+func readDeployOutput(stdout io.Reader, stderr io.Reader, emit func(stream string, text string)) {
+	var emitMut sync.Mutex
+	var wg sync.WaitGroup
+	read := func(stream string, r io.Reader) {
+		defer wg.Done()
+		reader := bufio.NewReaderSize(r, maxDeployLineSize)
+		var buf []byte
+		for {
+			line, isPrefix, err := reader.ReadLine()
+			buf = append(buf, line...)
+			if len(buf) > 0 && (!isPrefix || len(buf) >= maxDeployLineSize || err != nil) {
+				emitMut.Lock()
+				emit(stream, strings.TrimSuffix(string(buf), "\r"))
+				emitMut.Unlock()
+				buf = buf[:0]
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	wg.Add(2)
+	go read(StreamStdout, stdout)
+	go read(StreamStderr, stderr)
+	wg.Wait()
+}
+
+// DeployReplay 连上后补发输出前先告诉client补发多少行，Missed是已经不在缓冲区里的行数
+type DeployReplay struct {
+	Count  int
+	Missed int64
+}
+
+// deployLogRing 固定大小的环形缓冲区，满了覆盖最旧的
+type deployLogRing struct {
+	entries []DeployLine
+	next    int
+	full    bool
+}
+
+func newDeployLogRing(size int) *deployLogRing {
+	if size <= 0 {
+		size = defaultDeployLogLines
+	}
+	return &deployLogRing{entries: make([]DeployLine, size)}
+}
+
+func (ring *deployLogRing) add(line DeployLine) {
+	ring.entries[ring.next] = line
+	ring.next++
+	if ring.next == len(ring.entries) {
+		ring.next = 0
+		ring.full = true
+	}
+}
+
+// since 按顺序返回序号大于seq的行，limit大于0时只取最后limit行
+func (ring *deployLogRing) since(seq int64, limit int) []DeployLine {
+	var lines []DeployLine
+	start, count := 0, ring.next
+	if ring.full {
+		start, count = ring.next, len(ring.entries)
+	}
+	for i := 0; i < count; i++ {
+		line := ring.entries[(start+i)%len(ring.entries)]
+		if line.Seq > seq {
+			lines = append(lines, line)
+		}
+	}
+	if limit > 0 && len(lines) > limit {
+		lines = lines[len(lines)-limit:]
+	}
+	return lines
+}
+
+// emitDeployLine 给一行输出编号、存入缓冲区并放进订阅的client的发送队列；和补发用同一把锁，client不会漏行或重复。
+// 锁内只入队，不做网络io
+func (sp *serverProject) emitDeployLine(step string, stream string, text string) DeployLine {
+	sp.outputMut.Lock()
+	defer sp.outputMut.Unlock()
+	sp.outputSeq++
+	line := DeployLine{
+		Seq:    sp.outputSeq,
+		Time:   time.Now(),
+		Step:   step,
+		Stream: stream,
+		Text:   text,
+	}
+	sp.outputRing.add(line)
+	lineBytes, _ := json.Marshal(line)
+	sp.broadcastJson("deployLog", string(lineBytes))
+	return line
+}
+
+// subscribeWithReplay 订阅项目的deploy输出，先补发缓冲区里的行：
+// 同一次server运行期间的重连从lastSeq接着发，新client或server重启过则发最近的deploy-log-replay行
+func (session *Session) subscribeWithReplay(logEpoch int64, lastSeq int64) {
+	sp := session.project
+	sp.outputMut.Lock()
+	defer sp.outputMut.Unlock()
+	var lines []DeployLine
+	var missed int64
+	if logEpoch == sp.outputEpoch && lastSeq > 0 {
+		lines = sp.outputRing.since(lastSeq, 0)
+		if len(lines) > 0 && lines[0].Seq > lastSeq+1 {
+			missed = lines[0].Seq - lastSeq - 1
+		}
+	} else {
+		lines = sp.outputRing.since(0, sp.outputReplay)
+	}
+	// 补发的行不能把发送队列塞满
+	if limit := sessionSendQueue / 2; len(lines) > limit {
+		missed += int64(len(lines) - limit)
+		lines = lines[len(lines)-limit:]
+	}
+	if len(lines) > 0 {
+		replayBytes, _ := json.Marshal(DeployReplay{len(lines), missed})
+		session.writeJson("deployReplay", string(replayBytes))
+		for _, line := range lines {
+			lineBytes, _ := json.Marshal(line)
+			session.writeJson("deployLog", string(lineBytes))
+		}
+		log.Printf(PreLog+" session %d replay %d deploy log lines", session.Id, len(lines))
+	}
+	session.subscribe()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+const (
+	HashXxhash = "xxhash"
+	HashSha256 = "sha256"
+	HashMd5    = "md5"
+)
+
+// 默认按这个顺序协商：xxhash只用于变化检测，需要校验完整性时server只允许sha256；
+// md5不在默认里，双方都显式填了才会用
+var defaultHashes = []string{HashXxhash, HashSha256}
+
+func isSupportedHash(algo string) bool {
+	return algo == HashXxhash || algo == HashSha256 || algo == HashMd5
+}
+
+func newHasher(algo string) hash.Hash {
+	switch algo {
+	case HashSha256:
+		return sha256.New()
+	case HashMd5:
+		return md5.New()
+	}
+	return xxhash.New()
+}
+
+// negotiateHash 按client的优先级，选出第一个server也允许的hash算法，没有交集返回空
+func negotiateHash(clientHashes []string, serverHashes []string) string {
+	if len(serverHashes) == 0 {
+		serverHashes = defaultHashes
+	}
+	for _, algo := range clientHashes {
+		if !isSupportedHash(algo) {
+			continue
+		}
+		for _, allowed := range serverHashes {
+			if allowed == algo {
+				return algo
+			}
+		}
+	}
+	return ""
+}
+
+func hashBytes(algo string, data []byte) string {
+	hasher := newHasher(algo)
+	hasher.Write(data)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// hashFile 返回文件大小和hash
+func hashFile(algo string, filePath string) (int64, string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+	hasher := newHasher(algo)
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthTimeoutMs = 30000
+	healthPollInterval     = 500 * time.Millisecond
+)
+
+// HealthCheck deploy启动后的健康检查，http、tcp、log-regexp填一个；client配置，随sync请求发给server
+type HealthCheck struct {
+	Name      string `yaml:"name"`
+	Http      string `yaml:"http"`       // GET的url
+	Status    int    `yaml:"status"`     // http期望的状态码，默认200
+	Tcp       string `yaml:"tcp"`        // host:port，能连上即可
+	LogRegexp string `yaml:"log-regexp"` // deploy输出里出现匹配的行
+	TimeoutMs int    `yaml:"timeout-ms"` // 默认30000
+}
+
+type (
+	HealthCheckResult struct {
+		Name    string
+		Healthy bool
+		Detail  string
+		Elapsed time.Duration
+	}
+	// HealthRes 所有检查都通过才是healthy
+	HealthRes struct {
+		Healthy bool
+		Checks  []HealthCheckResult
+	}
+)
+
+func (check HealthCheck) displayName() string {
+	switch {
+	case check.Name != "":
+		return check.Name
+	case check.Http != "":
+		return "http " + check.Http
+	case check.Tcp != "":
+		return "tcp " + check.Tcp
+	default:
+		return "log /" + check.LogRegexp + "/"
+	}
+}
+
+// logWatch 在deploy输出里等某个正则
+type logWatch struct {
+	re      *regexp.Regexp
+	matched chan struct{}
+	once    sync.Once
+}
+
+// healthCheckRun 一次deploy的健康检查，log-regexp要在输出开始前准备好
+type healthCheckRun struct {
+	checks  []HealthCheck
+	watches map[int]*logWatch
+	errs    map[int]error
+}
+
+func newHealthCheckRun(checks []HealthCheck) *healthCheckRun {
+	run := &healthCheckRun{
+		checks:  checks,
+		watches: make(map[int]*logWatch),
+		errs:    make(map[int]error),
+	}
+	for i, check := range checks {
+		if check.Http == "" && check.Tcp == "" && check.LogRegexp == "" {
+			run.errs[i] = fmt.Errorf("one of http, tcp, log-regexp is required")
+			continue
+		}
+		if check.LogRegexp != "" {
+			re, err := regexp.Compile(check.LogRegexp)
+			if err != nil {
+				run.errs[i] = err
+				continue
+			}
+			run.watches[i] = &logWatch{re: re, matched: make(chan struct{})}
+		}
+	}
+	return run
+}
+
+// feedLine deploy每输出一行调用一次
+func (run *healthCheckRun) feedLine(text string) {
+	for _, watch := range run.watches {
+		if watch.re.MatchString(text) {
+			watch.once.Do(func() { close(watch.matched) })
+		}
+	}
+}
+
+// run 并发执行所有检查，各自到超时为止；deploy被停止时提前结束
+func (run *healthCheckRun) run(process *deployProcess) HealthRes {
+	results := make([]HealthCheckResult, len(run.checks))
+	var wg sync.WaitGroup
+	for i, check := range run.checks {
+		wg.Add(1)
+		go func(i int, check HealthCheck) {
+			defer wg.Done()
+			start := time.Now()
+			var err error
+			if err = run.errs[i]; err == nil {
+				err = run.runCheck(i, check, process)
+			}
+			results[i] = HealthCheckResult{
+				Name:    check.displayName(),
+				Healthy: err == nil,
+				Elapsed: time.Since(start),
+			}
+			if err != nil {
+				results[i].Detail = err.Error()
+			}
+		}(i, check)
+	}
+	wg.Wait()
+	res := HealthRes{Healthy: true, Checks: results}
+	for _, result := range results {
+		if !result.Healthy {
+			res.Healthy = false
+		}
+	}
+	return res
+}
+
+func (run *healthCheckRun) runCheck(i int, check HealthCheck, process *deployProcess) error {
+	timeoutMs := check.TimeoutMs
+	if timeoutMs <= 0 {
+		timeoutMs = defaultHealthTimeoutMs
+	}
+	timeout := time.After(time.Duration(timeoutMs) * time.Millisecond)
+	if watch := run.watches[i]; watch != nil {
+		select {
+		case <-watch.matched:
+			return nil
+		case <-process.exited:
+			// 输出已经结束，不会再匹配
+			select {
+			case <-watch.matched:
+				return nil
+			default:
+				return fmt.Errorf("cmd exited before log matched")
+			}
+		case <-process.stopping:
+			return fmt.Errorf("deploy stopped")
+		case <-timeout:
+			return fmt.Errorf("no log matched in %dms", timeoutMs)
+		}
+	}
+	// http、tcp轮询到成功为止，sh退出不代表服务没起来(可能是后台启动)
+	lastErr := fmt.Errorf("timeout")
+	for {
+		if check.Http != "" {
+			lastErr = probeHttp(check.Http, check.Status)
+		} else {
+			lastErr = probeTcp(check.Tcp)
+		}
+		if lastErr == nil {
+			return nil
+		}
+		select {
+		case <-process.stopping:
+			return fmt.Errorf("deploy stopped")
+		case <-timeout:
+			return fmt.Errorf("timeout after %dms, last err: %v", timeoutMs, lastErr)
+		case <-time.After(healthPollInterval):
+		}
+	}
+}
+
+var healthHttpClient = &http.Client{Timeout: 2 * time.Second}
+
+func probeHttp(url string, status int) error {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	res, err := healthHttpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != status {
+		return fmt.Errorf("status %d, expect %d", res.StatusCode, status)
+	}
+	return nil
+}
+
+func probeTcp(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// printHealthRes client打印健康检查结果，每项一行
+func (t *syncTarget) printHealthRes(res HealthRes) {
+	status := "healthy"
+	if !res.Healthy {
+		status = "unhealthy"
+	}
+	passed := 0
+	var lines []string
+	for _, check := range res.Checks {
+		result := "ok"
+		if check.Healthy {
+			passed++
+		} else {
+			result = "FAILED: " + check.Detail
+		}
+		lines = append(lines, fmt.Sprintf("  %s: %s (%v)", check.Name, result, check.Elapsed.Round(time.Millisecond)))
+	}
+	if res.Healthy {
+		t.log.Printf(PreLog+" health check: %s, %d/%d passed\n%s", status, passed, len(res.Checks), strings.Join(lines, "\n"))
+	} else {
+		t.log.Printf(PreError+" health check: %s, %d/%d passed\n%s", status, passed, len(res.Checks), strings.Join(lines, "\n"))
+	}
+	t.setDeployStatus(status)
+	t.profile.printSummary()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	fileNameSyncdsIgnore = ".syncdsignore"
+	fileNameGitIgnore    = ".gitignore"
+)
+
+type ignoreRule struct {
+	base    string // 规则所在目录，相对base-dir，根目录为空
+	negate  bool   // !开头，重新包含
+	dirOnly bool   // /结尾，只匹配目录
+	re      *regexp.Regexp
+}
+
+// ignoreMatcher gitignore语义的忽略规则，后面的规则优先，深层目录的规则排在后面
+type ignoreMatcher struct {
+	rules []ignoreRule
+}
+
+// loadIgnoreRules 读取base-dir下各级目录的.syncdsignore，use-gitignore时也读.gitignore；
+// 同一目录里.syncdsignore排在后面，可以覆盖.gitignore
+func loadIgnoreRules(baseDir string, useGitignore bool) *ignoreMatcher {
+	matcher := &ignoreMatcher{}
+	fileNames := []string{fileNameSyncdsIgnore}
+	if useGitignore {
+		fileNames = []string{fileNameGitIgnore, fileNameSyncdsIgnore}
+	}
+	base := filepath.Clean(baseDir)
+	_ = filepath.Walk(base, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		relativePath := formatFilePath(GetRelativeDirPath(base, filePath))
+		if relativePath == "." {
+			relativePath = ""
+		} else if info.Name() == ".git" || matcher.Ignored(relativePath, true) {
+			// 已忽略的目录(如node_modules)不用再往下找
+			return filepath.SkipDir
+		}
+		for _, fileName := range fileNames {
+			count, err := matcher.loadFile(filepath.Join(filePath, fileName), relativePath)
+			if err != nil && !os.IsNotExist(err) {
+				log.Println(PreError, "read ignore file err:", err)
+			}
+			if count > 0 {
+				log.Printf(PreLog + " load %d ignore rules from %s", count, path.Join(relativePath, fileName))
+			}
+		}
+		return nil
+	})
+	return matcher
+}
+
+func (matcher *ignoreMatcher) loadFile(filePath string, base string) (int, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	count := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreRule(scanner.Text(), base); ok {
+			matcher.rules = append(matcher.rules, rule)
+			count++
+		}
+	}
+	return count, scanner.Err()
+}
+
+func parseIgnoreRule(line string, base string) (ignoreRule, bool) {
+	line = strings.TrimRight(strings.TrimSuffix(line, "\r"), " ")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+	rule := ignoreRule{base: base}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		// \# \! 转义
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+	// 中间或开头有/的相对规则所在目录，否则匹配任意一级的文件名
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	expr := globToRegexp(line)
+	if !anchored {
+		expr = "(.*/)?" + expr
+	}
+	re, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		log.Println(PreError, "bad ignore rule:", line, err)
+		return ignoreRule{}, false
+	}
+	rule.re = re
+	return rule, true
+}
+
+// globToRegexp 支持*、?、[...]和**
+func globToRegexp(glob string) string {
+	var buf strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if strings.HasPrefix(glob[i:], "**") {
+				rest := glob[i+2:]
+				switch {
+				case strings.HasPrefix(rest, "/"):
+					// **/ 任意层目录，包括0层
+					buf.WriteString("(.*/)?")
+					i += 2
+				case rest == "":
+					buf.WriteString(".*")
+					i++
+				default:
+					buf.WriteString("[^/]*")
+					i++
+				}
+				continue
+			}
+			buf.WriteString("[^/]*")
+		case '?':
+			buf.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				buf.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				buf.WriteString(regexp.QuoteMeta(string(glob[i])))
+			}
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return buf.String()
+}
+
+// Ignored relativePath是相对base-dir、/分隔的路径；上级目录被忽略时，下面的文件也被忽略
+func (matcher *ignoreMatcher) Ignored(relativePath string, isDir bool) bool {
+	if len(matcher.rules) == 0 {
+		return false
+	}
+	relativePath = strings.Trim(formatFilePath(relativePath), "/")
+	names := strings.Split(relativePath, "/")
+	for i := 1; i < len(names); i++ {
+		if matcher.match(strings.Join(names[:i], "/"), true) {
+			return true
+		}
+	}
+	return matcher.match(relativePath, isDir)
+}
+
+func (matcher *ignoreMatcher) match(relativePath string, isDir bool) bool {
+	ignored := false
+	for _, rule := range matcher.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		rulePath := relativePath
+		if rule.base != "" {
+			if !strings.HasPrefix(relativePath, rule.base+"/") {
+				continue
+			}
+			rulePath = relativePath[len(rule.base)+1:]
+		}
+		if rule.re.MatchString(rulePath) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
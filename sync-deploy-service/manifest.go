@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// buildManifest 按ReWatcher相同的过滤规则遍历base-dir，列出所有文件的路径、大小、hash
+func (p *syncProfile) buildManifest(algo string) ([]FileMeta, error) {
+	baseAbsPath, _ := filepath.Abs(p.conf.BaseDir)
+	var fileMetas []FileMeta
+	err := p.walkWatchPaths(filepath.Clean(p.conf.BaseDir), func(path string, info os.FileInfo) {
+		if info.IsDir() {
+			return
+		}
+		absPath, _ := filepath.Abs(path)
+		fileMeta := FileMeta{
+			FilePath: strings.Replace(absPath, baseAbsPath, "", 1),
+			OptType:  OptWrite,
+		}
+		if err := p.fillFileMeta(&fileMeta, algo); err != nil {
+			return
+		}
+		fileMetas = append(fileMetas, fileMeta)
+	})
+	return fileMetas, err
+}
+
+// walkWatchPaths 遍历root下符合isWatchPath的文件和目录，root本身不回调
+func (p *syncProfile) walkWatchPaths(root string, fn func(path string, info os.FileInfo)) error {
+	base := filepath.Clean(p.conf.BaseDir)
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		relativePath := GetRelativeDirPath(base, path)
+		if relativePath == "." {
+			return nil
+		}
+		if !p.isWatchPath(relativePath, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if path != root || !info.IsDir() {
+			fn(path, info)
+		}
+		return nil
+	})
+}
+
+// fillFileMeta 补上文件大小、hash和要保留的属性
+func (p *syncProfile) fillFileMeta(fileMeta *FileMeta, algo string) error {
+	filePath := filepath.Join(p.conf.BaseDir, fileMeta.FilePath)
+	stat, err := os.Lstat(filePath)
+	if err != nil {
+		return err
+	}
+	isLink, err := readFileAttrs(fileMeta, stat, filePath, algo, clientSkipAttrs(p.conf))
+	if err != nil || isLink {
+		return err
+	}
+	size, hashCode, err := hashFile(algo, filePath)
+	if err != nil {
+		return err
+	}
+	fileMeta.Size = size
+	fileMeta.Hash = hashCode
+	return nil
+}
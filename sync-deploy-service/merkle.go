@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// ManifestReq 一次请求展开同一层的多个目录；对账的第一个请求(根目录)带上client要对账的所有文件，
+	// server只对这些文件算hash，server上多出来的文件不影响目录hash
+	ManifestReq struct {
+		Id    int64
+		Paths []string // 相对base-dir，用/分隔，空表示根目录
+		Scope []ManifestScope
+	}
+	// ManifestScope client要对账的一个文件，带上要保留的属性，属性不一致的文件也要同步
+	ManifestScope struct {
+		Path    string
+		Mode    os.FileMode
+		ModTime time.Time
+	}
+	ManifestEntry struct {
+		Name  string
+		IsDir bool
+		Hash  string
+		Size  int64
+	}
+	// ManifestDir 只返回一层，client对比目录hash后再决定要不要往下钻
+	ManifestDir struct {
+		Path    string
+		Exists  bool
+		Hash    string
+		Entries []ManifestEntry
+	}
+	ManifestRes struct {
+		Id    int64
+		Dirs  []ManifestDir
+		Error string
+	}
+)
+
+type merkleNode struct {
+	IsDir    bool
+	Hash     string
+	Size     int64
+	Children map[string]*merkleNode
+}
+
+func (node *merkleNode) entries() []ManifestEntry {
+	entries := make([]ManifestEntry, 0, len(node.Children))
+	for name, child := range node.Children {
+		entries = append(entries, ManifestEntry{name, child.IsDir, child.Hash, child.Size})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// dirHash 目录hash由子节点的名字、类型、hash决定，client、server算法一致才能比较
+func dirHash(algo string, entries []ManifestEntry) string {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	hasher := newHasher(algo)
+	for _, entry := range entries {
+		typ := "f"
+		if entry.IsDir {
+			typ = "d"
+		}
+		_, _ = fmt.Fprintf(hasher, "%s\x00%s\x00%s\n", entry.Name, typ, entry.Hash)
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func newDirNode() *merkleNode {
+	return &merkleNode{IsDir: true, Children: make(map[string]*merkleNode)}
+}
+
+func (node *merkleNode) updateDirHash(algo string) {
+	var size int64
+	for _, child := range node.Children {
+		if child.IsDir {
+			child.updateDirHash(algo)
+		}
+		size += child.Size
+	}
+	node.Size = size
+	node.Hash = dirHash(algo, node.entries())
+}
+
+func (node *merkleNode) lookup(path string) *merkleNode {
+	for _, name := range strings.Split(path, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		if node == nil || !node.IsDir {
+			return nil
+		}
+		node = node.Children[name]
+	}
+	return node
+}
+
+// attrsDifferMark 加在属性不一致的文件hash后面，client那边一定对不上，会钻下来同步属性
+const attrsDifferMark = ":attrs"
+
+// buildScopedTree 只对client列出的文件建hash树，文件hash走calcFileHash的缓存，没改过的文件只需要stat
+func (sp *serverProject) buildScopedTree(algo string, scope []ManifestScope) *merkleNode {
+	root := newDirNode()
+	for _, item := range scope {
+		relativePath := item.Path
+		filePath, err := sp.resolveSyncPath(relativePath)
+		if err != nil {
+			continue
+		}
+		stat, err := os.Lstat(filePath)
+		if err != nil {
+			continue
+		}
+		var leaf *merkleNode
+		if stat.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(filePath)
+			if err != nil {
+				continue
+			}
+			leaf = &merkleNode{Hash: symlinkHash(algo, target), Size: int64(len(target))}
+		} else if stat.Mode().IsRegular() {
+			hashCode, err := calcFileHash(algo, filePath)
+			if err != nil {
+				continue
+			}
+			leaf = &merkleNode{Hash: hashCode, Size: stat.Size()}
+			if attrsDiffer(stat, FileMeta{Mode: item.Mode, ModTime: item.ModTime}) {
+				leaf.Hash += attrsDifferMark
+			}
+		} else {
+			continue
+		}
+		names := strings.Split(strings.Trim(formatFilePath(relativePath), "/"), "/")
+		node := root
+		for _, name := range names[:len(names)-1] {
+			child, ok := node.Children[name]
+			if !ok {
+				child = newDirNode()
+				node.Children[name] = child
+			}
+			node = child
+		}
+		node.Children[names[len(names)-1]] = leaf
+	}
+	root.updateDirHash(algo)
+	return root
+}
+
+// handleManifest 根目录的请求按scope重建这个连接的hash树，同一次对账后面的请求都用这一份
+func (session *Session) handleManifest(req ManifestReq) {
+	res := ManifestRes{Id: req.Id}
+	for _, path := range req.Paths {
+		if path == "" {
+			start := time.Now()
+			session.manifest = session.project.buildScopedTree(session.Hash, req.Scope)
+			log.Printf(PreLog+" merkle tree (%s) of %d files built in %v", session.Hash, len(req.Scope), time.Since(start))
+		}
+	}
+	if session.manifest == nil {
+		res.Error = "manifest of root dir not requested"
+	}
+	for _, path := range req.Paths {
+		dir := ManifestDir{Path: path}
+		if node := session.manifest.lookup(formatFilePath(path)); node != nil {
+			dir.Exists = true
+			dir.Hash = node.Hash
+			if node.IsDir {
+				dir.Entries = node.entries()
+			}
+		}
+		res.Dirs = append(res.Dirs, dir)
+	}
+	resBytes, _ := json.Marshal(res)
+	session.writeJson("manifestRes", string(resBytes))
+}
+
+// client端
+
+const manifestTimeout = 30 * time.Second
+
+var (
+	lastManifestId int64
+	manifestMut    sync.Mutex
+	manifestWaits  = make(map[int64]chan ManifestRes)
+)
+
+func (t *syncTarget) requestManifest(req ManifestReq) (ManifestRes, error) {
+	id := atomic.AddInt64(&lastManifestId, 1)
+	req.Id = id
+	resChan := make(chan ManifestRes, 1)
+	manifestMut.Lock()
+	manifestWaits[id] = resChan
+	manifestMut.Unlock()
+	defer func() {
+		manifestMut.Lock()
+		delete(manifestWaits, id)
+		manifestMut.Unlock()
+	}()
+
+	t.sendWsReq("manifest", req)
+	select {
+	case res := <-resChan:
+		if res.Error != "" {
+			return res, fmt.Errorf("%s", res.Error)
+		}
+		return res, nil
+	case <-time.After(manifestTimeout):
+		return ManifestRes{}, fmt.Errorf("wait manifest of %d dirs timeout", len(req.Paths))
+	}
+}
+
+func dispatchManifestRes(data string) {
+	var res ManifestRes
+	err := json.Unmarshal([]byte(data), &res)
+	if err != nil {
+		log.Printf(PreError+" read manifestRes err: %v", err)
+		return
+	}
+	manifestMut.Lock()
+	resChan, ok := manifestWaits[res.Id]
+	manifestMut.Unlock()
+	if ok {
+		resChan <- res
+	}
+}
+
+// buildLocalTree 用本地清单构建同样结构的hash树，叶子节点挂上对应的FileMeta
+func buildLocalTree(algo string, fileMetas []FileMeta) (*merkleNode, map[string]FileMeta) {
+	root := newDirNode()
+	byPath := make(map[string]FileMeta)
+	for _, fileMeta := range fileMetas {
+		relativePath := strings.TrimPrefix(formatFilePath(fileMeta.FilePath), "/")
+		byPath[relativePath] = fileMeta
+		names := strings.Split(relativePath, "/")
+		node := root
+		for _, name := range names[:len(names)-1] {
+			child, ok := node.Children[name]
+			if !ok {
+				child = newDirNode()
+				node.Children[name] = child
+			}
+			node = child
+		}
+		node.Children[names[len(names)-1]] = &merkleNode{Hash: fileMeta.Hash, Size: fileMeta.Size}
+	}
+	root.updateDirHash(algo)
+	return root, byPath
+}
+
+// compareWithServer 从根目录开始逐层比较，只钻进hash不一致的子目录，同一层的目录一次请求，返回需要diff的文件；
+// 内容一致、属性不一致的文件也会返回，diff时server回复只更新属性
+func (t *syncTarget) compareWithServer(fileMetas []FileMeta) ([]FileMeta, error) {
+	t.connMut.Lock()
+	algo := t.hashAlgo
+	t.connMut.Unlock()
+	root, byPath := buildLocalTree(algo, fileMetas)
+	scope := make([]ManifestScope, 0, len(byPath))
+	for path, fileMeta := range byPath {
+		scope = append(scope, ManifestScope{path, fileMeta.Mode, fileMeta.ModTime})
+	}
+	var changed []FileMeta
+	requested, rounds := 0, 0
+	type dirItem struct {
+		path string
+		node *merkleNode
+	}
+	level := []dirItem{{"", root}}
+	for len(level) > 0 {
+		req := ManifestReq{}
+		for _, item := range level {
+			req.Paths = append(req.Paths, item.path)
+		}
+		if rounds == 0 {
+			req.Scope = scope
+		}
+		res, err := t.requestManifest(req)
+		if err != nil {
+			return nil, err
+		}
+		rounds++
+		requested += len(level)
+		serverDirs := make(map[string]ManifestDir)
+		for _, dir := range res.Dirs {
+			serverDirs[dir.Path] = dir
+		}
+		var next []dirItem
+		for _, item := range level {
+			serverDir := serverDirs[item.path]
+			if item.path == "" && serverDir.Hash == item.node.Hash {
+				// 整个目录树一致
+				break
+			}
+			serverEntries := make(map[string]ManifestEntry)
+			for _, entry := range serverDir.Entries {
+				serverEntries[entry.Name] = entry
+			}
+			for name, child := range item.node.Children {
+				childPath := name
+				if item.path != "" {
+					childPath = item.path + "/" + name
+				}
+				entry, ok := serverEntries[name]
+				if ok && entry.IsDir == child.IsDir && entry.Hash == child.Hash {
+					continue
+				}
+				if child.IsDir {
+					// server上没有这个目录，不用再问了，下面的文件全部要同步
+					if !ok || !entry.IsDir {
+						changed = append(changed, collectFiles(childPath, byPath)...)
+						continue
+					}
+					next = append(next, dirItem{childPath, child})
+					continue
+				}
+				changed = append(changed, byPath[childPath])
+			}
+		}
+		level = next
+	}
+	t.log.Printf(PreLog+" merkle compare %d files, requested %d dirs in %d rounds, %d files differ", len(fileMetas), requested, rounds, len(changed))
+	return changed, nil
+}
+
+func collectFiles(dirPath string, byPath map[string]FileMeta) []FileMeta {
+	var fileMetas []FileMeta
+	for path, fileMeta := range byPath {
+		if strings.HasPrefix(path, dirPath+"/") {
+			fileMetas = append(fileMetas, fileMeta)
+		}
+	}
+	return fileMetas
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/bluele/gcache"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBuildScopedTreeAttrsDiffer(t *testing.T) {
+	if hashCache == nil {
+		hashCache = gcache.New(16).LFU().Build()
+	}
+	session, baseDir := newApplySession(t)
+	filePath := filepath.Join(baseDir, "run.sh")
+	writeTestFile(t, filePath, "echo run")
+	modTime := time.Unix(1700000000, 0)
+	if err := os.Chmod(filePath, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filePath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	hashCode, err := calcFileHash(HashSha256, filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	same := session.project.buildScopedTree(HashSha256, []ManifestScope{{"run.sh", 0644, modTime}})
+	if leaf := same.lookup("run.sh"); leaf == nil || leaf.Hash != hashCode {
+		t.Fatalf("same attrs: expected leaf hash %s, got %+v", hashCode, leaf)
+	}
+	// 离线时改了权限、修改时间，内容没变，根hash也要对不上
+	for _, item := range []ManifestScope{{"run.sh", 0755, modTime}, {"run.sh", 0644, modTime.Add(time.Hour)}} {
+		tree := session.project.buildScopedTree(HashSha256, []ManifestScope{item})
+		if tree.Hash == same.Hash {
+			t.Errorf("%v %v: expected root hash to differ", item.Mode, item.ModTime)
+		}
+		if leaf := tree.lookup("run.sh"); leaf == nil || leaf.Hash == hashCode {
+			t.Errorf("%v %v: expected leaf hash to differ, got %+v", item.Mode, item.ModTime, leaf)
+		}
+	}
+}
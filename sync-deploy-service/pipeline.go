@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const defaultStepTimeoutMs = 300000
+
+const (
+	StepRunning = "running"
+	StepOk      = "ok"
+	StepFailed  = "failed"
+	StepSkipped = "skipped"
+)
+
+const (
+	OnFailureAbort    = "abort"
+	OnFailureContinue = "continue"
+)
+
+// DeployStep deploy流水线的一步，client配置，随sync请求发给server；
+// service为true的是要一直运行的服务，启动后(有health-checks时等检查通过)就执行下一步，下次deploy时停止
+type DeployStep struct {
+	Name      string `yaml:"name"`
+	Cmd       string `yaml:"cmd"`
+	TimeoutMs int    `yaml:"timeout-ms"` // 普通步骤的超时，默认300000；service步骤不限制
+	OnFailure string `yaml:"on-failure"` // abort(默认)或continue
+	Service   bool   `yaml:"service"`
+}
+
+type (
+	// DeployStepRes 每一步开始和结束时发给client
+	DeployStepRes struct {
+		Index   int
+		Total   int
+		Name    string
+		Status  string
+		Detail  string
+		Elapsed time.Duration
+	}
+	// PipelineRes 整个流水线的结果，有一步失败就不算成功
+	PipelineRes struct {
+		Success bool
+		Steps   []DeployStepRes
+	}
+)
+
+var errPipelineCancelled = errors.New("cancelled by a newer deploy")
+
+// pipelineRun 一次deploy；没配deploy-steps时deploy-cmd就是唯一的service步骤，不发步骤进度，和原来一样
+type pipelineRun struct {
+	sp           *serverProject
+	pipeline     bool
+	cancel       chan struct{}
+	healthChecks []HealthCheck
+}
+
+func (run *pipelineRun) cancelled() bool {
+	select {
+	case <-run.cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+func (run *pipelineRun) sendStep(res DeployStepRes) {
+	if !run.pipeline {
+		return
+	}
+	resBytes, _ := json.Marshal(res)
+	run.sp.broadcastJson("deployStep", string(resBytes))
+}
+
+func (run *pipelineRun) sendDeployRes(data string) {
+	if !run.pipeline {
+		run.sp.broadcastJson("deployRes", data)
+	}
+}
+
+func (run *pipelineRun) emitOutput(step string) func(stream string, text string) {
+	return func(stream string, text string) {
+		line := run.sp.emitDeployLine(step, stream, text)
+		tag := stream
+		if step != "" {
+			tag = step + "/" + stream
+		}
+		fmt.Printf("%s [%s] %s\n", line.Time.Format(deployTimeFormat), tag, text)
+	}
+}
+
+// startService 启动服务进程组，输出在后台一直读到进程退出；配了health-checks时流水线等检查结果
+func (run *pipelineRun) startService(step DeployStep) error {
+	sp := run.sp
+	cmd := exec.Command("sh", "-c", step.Cmd)
+	stdout, _ := cmd.StdoutPipe()
+	stderr, _ := cmd.StderrPipe()
+	sp.mut.Lock()
+	process, err := startDeployProcess(cmd)
+	if err == nil {
+		sp.process = process
+	}
+	sp.mut.Unlock()
+	if err != nil {
+		run.sendDeployRes("cmd start failed, err:" + err.Error())
+		log.Println("cmd start failed, err:" + err.Error())
+		return err
+	}
+	run.sendDeployRes("cmd start success")
+	log.Println("cmd start success")
+
+	var health *healthCheckRun
+	if len(run.healthChecks) > 0 {
+		health = newHealthCheckRun(run.healthChecks)
+	}
+	go func() {
+		// stdout、stderr同时读，按读到的先后发给client
+		emit := run.emitOutput(step.Name)
+		readDeployOutput(stdout, stderr, func(stream string, text string) {
+			emit(stream, text)
+			if health != nil {
+				health.feedLine(text)
+			}
+		})
+		err := cmd.Wait()
+		close(process.exited)
+		if process.stopped() {
+			log.Printf(PreLog+" cmd stopped: %s", step.Cmd)
+		} else if err != nil {
+			sp.broadcastJson("deployRes", "cmd exec failed, err:"+err.Error())
+			log.Printf(PreError+" cmd exec failed, err: %v", err)
+		}
+	}()
+	if health == nil {
+		return nil
+	}
+
+	healthResChan := make(chan HealthRes, 1)
+	go func() {
+		res := health.run(process)
+		log.Printf(PreLog+" health check of `%s`, healthy: %t", sp.label(), res.Healthy)
+		resBytes, _ := json.Marshal(res)
+		sp.broadcastJson("healthRes", string(resBytes))
+		healthResChan <- res
+	}()
+	if !run.pipeline {
+		return nil
+	}
+	// 后面的步骤(如smoke-test)要等服务起来
+	select {
+	case res := <-healthResChan:
+		if !res.Healthy {
+			return fmt.Errorf("unhealthy")
+		}
+		return nil
+	case <-run.cancel:
+		return errPipelineCancelled
+	}
+}
+
+// runStep 执行普通步骤直到退出，超时或被新的deploy取消时停掉它的进程组
+func (run *pipelineRun) runStep(step DeployStep) error {
+	sp := run.sp
+	timeoutMs := step.TimeoutMs
+	if timeoutMs <= 0 {
+		timeoutMs = defaultStepTimeoutMs
+	}
+	cmd := exec.Command("sh", "-c", step.Cmd)
+	stdout, _ := cmd.StdoutPipe()
+	stderr, _ := cmd.StderrPipe()
+	sp.mut.Lock()
+	process, err := startDeployProcess(cmd)
+	if err == nil {
+		sp.stepProcess = process
+	}
+	sp.mut.Unlock()
+	if err != nil {
+		return err
+	}
+
+	timedOut := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-time.After(time.Duration(timeoutMs) * time.Millisecond):
+			close(timedOut)
+		case <-run.cancel:
+		case <-finished:
+			return
+		}
+		sp.mut.Lock()
+		sp.terminateProcess(process, "")
+		sp.mut.Unlock()
+	}()
+	readDeployOutput(stdout, stderr, run.emitOutput(step.Name))
+	err = cmd.Wait()
+	close(process.exited)
+	close(finished)
+	sp.mut.Lock()
+	sp.stepProcess = nil
+	sp.mut.Unlock()
+
+	select {
+	case <-timedOut:
+		return fmt.Errorf("timeout after %dms", timeoutMs)
+	default:
+	}
+	if run.cancelled() {
+		return errPipelineCancelled
+	}
+	return err
+}
+
+// printDeployStep client打印每一步的进度
+func (t *syncTarget) printDeployStep(res DeployStepRes) {
+	switch res.Status {
+	case StepRunning:
+		t.log.Printf(PreLog+" deploy step %d/%d %s: running", res.Index, res.Total, res.Name)
+	case StepFailed:
+		t.log.Printf(PreError+" deploy step %d/%d %s: failed in %v, err: %s", res.Index, res.Total, res.Name, res.Elapsed.Round(time.Millisecond), res.Detail)
+	case StepSkipped:
+		t.log.Printf(PreLog+" deploy step %d/%d %s: skipped", res.Index, res.Total, res.Name)
+	default:
+		t.log.Printf(PreLog+" deploy step %d/%d %s: %s in %v", res.Index, res.Total, res.Name, res.Status, res.Elapsed.Round(time.Millisecond))
+	}
+	t.setDeployStatus(fmt.Sprintf("step %d/%d %s %s", res.Index, res.Total, res.Name, res.Status))
+}
+
+// printPipelineRes client打印流水线的最终结果，每步一行
+func (t *syncTarget) printPipelineRes(res PipelineRes) {
+	status := "success"
+	if !res.Success {
+		status = "failed"
+	}
+	var lines []string
+	for _, step := range res.Steps {
+		line := fmt.Sprintf("  %d. %s: %s", step.Index, step.Name, step.Status)
+		if step.Status != StepSkipped {
+			line += fmt.Sprintf(" (%v)", step.Elapsed.Round(time.Millisecond))
+		}
+		if step.Detail != "" {
+			line += ", " + step.Detail
+		}
+		lines = append(lines, line)
+	}
+	if res.Success {
+		t.log.Printf(PreLog+" deploy pipeline %s\n%s", status, strings.Join(lines, "\n"))
+	} else {
+		t.log.Printf(PreError+" deploy pipeline %s\n%s", status, strings.Join(lines, "\n"))
+	}
+	t.setDeployStatus("pipeline " + status)
+	t.profile.printSummary()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// syncProfile 一组独立的同步配置：自己的base-dir、过滤规则、watcher、deploy命令和server连接
+type syncProfile struct {
+	name    string
+	conf    ClientConf
+	ignore  *ignoreMatcher
+	targets []*syncTarget
+	log     *log.Logger
+}
+
+// newSyncProfiles 按配置和命令行选出要运行的profile；enabled不为空时只运行这些(包括配置里disabled的)，再去掉disabled
+func newSyncProfiles(confs []ClientConf, enabled []string, disabled []string) ([]*syncProfile, error) {
+	known := make(map[string]bool)
+	for _, conf := range confs {
+		known[conf.Name] = true
+	}
+	for _, name := range append(append([]string{}, enabled...), disabled...) {
+		if !known[name] {
+			return nil, fmt.Errorf("profile `%s` not found in %s", name, fileNameClientConfig)
+		}
+	}
+
+	var profiles []*syncProfile
+	for _, conf := range confs {
+		run := !conf.Disabled
+		if len(enabled) > 0 {
+			run = containsString(enabled, conf.Name)
+		}
+		if containsString(disabled, conf.Name) {
+			run = false
+		}
+		if !run {
+			log.Printf(PreLog+" profile `%s` disabled", conf.Name)
+			continue
+		}
+		profiles = append(profiles, &syncProfile{name: conf.Name, conf: conf})
+	}
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("no profile enabled")
+	}
+	for _, p := range profiles {
+		prefix := ""
+		if len(profiles) > 1 {
+			prefix = "[" + p.name + "] "
+		}
+		p.log = log.New(os.Stderr, prefix, log.LstdFlags|log.Lmsgprefix)
+		// watch和对账都按忽略规则筛选，先加载
+		p.ignore = loadIgnoreRules(p.conf.BaseDir, p.conf.UseGitignore)
+		p.targets = newSyncTargets(p, len(profiles) > 1)
+	}
+	return profiles, nil
+}
+
+// start 每个profile一个watcher，每台server一条连接
+func (p *syncProfile) start(done chan struct{}) {
+	go p.watch(done)
+	for _, t := range p.targets {
+		go t.connectWs(done)
+	}
+}
+
+func containsString(items []string, item string) bool {
+	for _, it := range items {
+		if it == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serverProject server上的一个项目：自己的base-dir、允许的deploy命令、受保护路径、目录hash树和deploy进程
+type serverProject struct {
+	name           string // 为空表示没配projects，接受client的任意项目名
+	baseDir        string
+	secret         string
+	httpPassword   string
+	deployCmds     []string
+	healthChecks   []HealthCheck
+	protectedPaths []string
+	stopGrace      time.Duration
+	deployPorts    []int
+	// 同一项目同一时间只有一个服务进程组和一个正在执行的流水线
+	mut            sync.Mutex
+	process        *deployProcess
+	stepProcess    *deployProcess // 流水线里正在执行的普通步骤
+	pipelineMut    sync.Mutex
+	pipelineCancel chan struct{}
+	// deploy输出的序号和最近的输出，epoch区分server的每次运行
+	outputMut    sync.Mutex
+	outputSeq    int64
+	outputEpoch  int64
+	outputRing   *deployLogRing
+	outputReplay int
+}
+
+var (
+	serverProjects = make(map[string]*serverProject)
+	defaultProject *serverProject
+)
+
+// initServerProjects 没配projects时外层的base-dir就是唯一的项目，兼容旧配置
+func initServerProjects(conf ServerConf) error {
+	if len(conf.Projects) == 0 {
+		defaultProject = newServerProject(conf, ServerProjectConf{
+			BaseDir:      conf.BaseDir,
+			DeployCmds:   conf.DeployCmds,
+			HealthChecks: conf.HealthChecks,
+			StopGraceMs:  conf.StopGraceMs,
+			DeployPorts:  conf.DeployPorts,
+		})
+		return nil
+	}
+	for _, projectConf := range conf.Projects {
+		if projectConf.Name == "" || projectConf.BaseDir == "" {
+			return fmt.Errorf("project name and base-dir are required")
+		}
+		if _, ok := serverProjects[projectConf.Name]; ok {
+			return fmt.Errorf("duplicated project `%s`", projectConf.Name)
+		}
+		serverProjects[projectConf.Name] = newServerProject(conf, projectConf)
+		log.Printf(PreLog+" project `%s` at %s, %d deploy cmds allowed", projectConf.Name, projectConf.BaseDir, len(projectConf.DeployCmds))
+	}
+	return nil
+}
+
+// newServerProject 项目没填的secret、http-password、stop-grace-ms沿用外层，protected-paths在外层的基础上追加
+func newServerProject(conf ServerConf, projectConf ServerProjectConf) *serverProject {
+	sp := &serverProject{
+		name:           projectConf.Name,
+		baseDir:        projectConf.BaseDir,
+		secret:         projectConf.Secret,
+		httpPassword:   projectConf.HttpPassword,
+		deployCmds:     projectConf.DeployCmds,
+		healthChecks:   projectConf.HealthChecks,
+		protectedPaths: append(append([]string{}, conf.ProtectedPaths...), projectConf.ProtectedPaths...),
+		deployPorts:    projectConf.DeployPorts,
+		outputEpoch:    time.Now().UnixNano(),
+		outputRing:     newDeployLogRing(conf.DeployLogLines),
+		outputReplay:   conf.DeployLogReplay,
+	}
+	if sp.secret == "" {
+		sp.secret = conf.Secret
+	}
+	if sp.httpPassword == "" {
+		sp.httpPassword = conf.HttpPassword
+	}
+	stopGraceMs := projectConf.StopGraceMs
+	if stopGraceMs <= 0 {
+		stopGraceMs = conf.StopGraceMs
+	}
+	if stopGraceMs <= 0 {
+		stopGraceMs = defaultStopGraceMs
+	}
+	sp.stopGrace = time.Duration(stopGraceMs) * time.Millisecond
+	if sp.outputReplay <= 0 {
+		sp.outputReplay = defaultDeployLogReplay
+	}
+	return sp
+}
+
+// findServerProject client在握手时指定项目，找不到返回nil
+func findServerProject(name string) *serverProject {
+	if defaultProject != nil {
+		return defaultProject
+	}
+	return serverProjects[name]
+}
+
+// label 日志里的项目名
+func (sp *serverProject) label() string {
+	if sp.name == "" {
+		return "default"
+	}
+	return sp.name
+}
+
+func allServerProjects() []*serverProject {
+	if defaultProject != nil {
+		return []*serverProject{defaultProject}
+	}
+	var projects []*serverProject
+	for _, sp := range serverProjects {
+		projects = append(projects, sp)
+	}
+	sort.Slice(projects, func(i, j int) bool { return projects[i].name < projects[j].name })
+	return projects
+}
+
+// httpProject 配了projects时url第一级是项目名，返回项目和项目下的路径；根路径返回nil和空路径
+func httpProject(urlPath string) (*serverProject, string) {
+	if defaultProject != nil {
+		return defaultProject, urlPath
+	}
+	names := strings.SplitN(urlPath, "/", 2)
+	if names[0] == "" {
+		return nil, ""
+	}
+	sp := serverProjects[names[0]]
+	if sp == nil {
+		return nil, names[0]
+	}
+	if len(names) == 1 {
+		return sp, ""
+	}
+	return sp, names[1]
+}
+
+func hasHttpPassword() bool {
+	if serverConf.HttpPassword != "" {
+		return true
+	}
+	for _, sp := range allServerProjects() {
+		if sp.httpPassword != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func genProjectIndex(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = fmt.Fprintf(w, "<h1>Projects</h1>")
+	_, _ = fmt.Fprintf(w, "<style>td{padding: 5px}</style>")
+	_, _ = fmt.Fprintf(w, "<table>\n<tr><td>项目</td></tr>\n")
+	for _, sp := range allServerProjects() {
+		urlObj := url.URL{Path: "/" + sp.name + "/"}
+		_, _ = fmt.Fprintf(w, "<tr><td><a href=\"%s\">%s</a></td></tr>\n", urlObj.String(), sp.name)
+	}
+	_, _ = fmt.Fprintf(w, "</table>\n")
+}
+
+// checkDeploy deploy-cmd、deploy-kill-cmd和每一步的cmd都要允许，http、tcp健康检查也要允许；service步骤最多一个，下次deploy时只停这一个服务
+func (sp *serverProject) checkDeploy(req SyncReq) error {
+	services := 0
+	for _, step := range req.DeploySteps {
+		if step.Service {
+			services++
+		}
+	}
+	if services > 1 {
+		return fmt.Errorf("only one service step is allowed, got %d", services)
+	}
+	cmds := []string{req.DeployCmd, req.DeployKillCmd}
+	for _, step := range req.DeploySteps {
+		cmds = append(cmds, step.Cmd)
+	}
+	for _, cmd := range cmds {
+		if cmd != "" && !sp.allowsDeployCmd(cmd) {
+			return fmt.Errorf("deploy cmd not allowed: %s", cmd)
+		}
+	}
+	for _, check := range req.HealthChecks {
+		if !sp.allowsHealthCheck(check) {
+			return fmt.Errorf("health check not allowed: %s", check.displayName())
+		}
+	}
+	return nil
+}
+
+// allowsHealthCheck http、tcp检查由server发起请求，配置了deploy-cmds或health-checks时要和health-checks里的某一项目标一致；
+// log-regexp只看deploy输出，不限制
+func (sp *serverProject) allowsHealthCheck(check HealthCheck) bool {
+	if check.Http == "" && check.Tcp == "" {
+		return true
+	}
+	if len(sp.deployCmds) == 0 && len(sp.healthChecks) == 0 {
+		return true
+	}
+	for _, allowed := range sp.healthChecks {
+		if allowed.Http == check.Http && allowed.Tcp == check.Tcp {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsDeployCmd 配置了deploy-cmds时只允许执行列表里的命令，没配时不限制
+func (sp *serverProject) allowsDeployCmd(cmd string) bool {
+	if len(sp.deployCmds) == 0 {
+		return true
+	}
+	cmd = strings.TrimSpace(cmd)
+	for _, allowed := range sp.deployCmds {
+		if strings.TrimSpace(allowed) == cmd {
+			return true
+		}
+	}
+	return false
+}
@@ -15,6 +15,7 @@ import (
 type WatchEvent struct {
 	Error error
 	Body  *fsnotify.Event
+	IsDir bool // 删除、改名时路径已经不在了，按之前监听的目录判断
 }
 
 type WatchFilterFunc func(relativeBasePath string, isDir  bool) bool
@@ -26,6 +27,7 @@ type ReWatcher struct {
 	debug    bool
 	safename string // safe path
 	watcher  *fsnotify.Watcher
+	dirs     map[string]bool // 已监听的目录
 	events   chan WatchEvent // one channel for events and err...
 	closed   bool            // is the events channel closed?
 	mutex    sync.Mutex      // lock guarding the channel closing
@@ -48,6 +50,7 @@ func (obj *ReWatcher) Init() error {
 	obj.watcher = nil
 	obj.events = make(chan WatchEvent)
 	obj.exit = make(chan struct{})
+	obj.dirs = make(map[string]bool)
 	obj.safename = filepath.Clean(obj.Path)          // no trailing slash
 
 	var err error
@@ -129,31 +132,32 @@ func (obj *ReWatcher) Watch() error {
 			if obj.debug {
 				log.Printf("event(%s): %s", event.Name, event.Op.String())
 			}
-			if !obj.testWatch(event.Name, isDir(event.Name)) {
+			eventIsDir := isDir(event.Name)
+			if event.Op&(fsnotify.Rename|fsnotify.Remove) != 0 {
+				eventIsDir = obj.dirs[event.Name]
+			}
+			if !obj.testWatch(event.Name, eventIsDir) {
 				continue
 			}
 			if event.Op&fsnotify.Write == fsnotify.Write {
-				if isDir(event.Name) {
+				if eventIsDir {
 					continue
 				}
 			} else if event.Op&fsnotify.Create == fsnotify.Create {
-				obj.watcher.Add(event.Name)
-				if isDir(event.Name) {
+				if eventIsDir {
 					if err := obj.addSubFolders(event.Name); err != nil {
 						log.Printf("new addSubFolders err: %v", err)
 					}
 				}
-			} else if event.Op&fsnotify.Rename == fsnotify.Rename {
-				obj.watcher.Remove(event.Name)
-				obj.watcher.Add(event.Name)
-			} else if event.Op&fsnotify.Remove == fsnotify.Remove {
-				obj.watcher.Remove(event.Name)
+			} else if event.Op&(fsnotify.Rename|fsnotify.Remove) != 0 {
+				// 目录移走后子目录的监听还挂在旧路径上，一并去掉
+				obj.removeSubFolders(event.Name)
 			}
 
 			// only invalid state on certain types of events
 			select {
 			// exit even when we're blocked on event sending
-			case obj.events <- WatchEvent{Error: nil, Body: &event}:
+			case obj.events <- WatchEvent{Error: nil, Body: &event, IsDir: eventIsDir}:
 			case <-obj.exit:
 				return fmt.Errorf("pending event not sent")
 			}
@@ -196,6 +200,7 @@ func (obj *ReWatcher) addSubFolders(p string) error {
 			if err != nil {
 				return err
 			}
+			obj.dirs[path] = true
 		}
 		return nil
 	}
@@ -203,6 +208,16 @@ func (obj *ReWatcher) addSubFolders(p string) error {
 	return err
 }
 
+// removeSubFolders 删除、移走目录时取消它和子目录的监听
+func (obj *ReWatcher) removeSubFolders(p string) {
+	for dir := range obj.dirs {
+		if dir == p || strings.HasPrefix(dir, p+string(filepath.Separator)) {
+			_ = obj.watcher.Remove(dir)
+			delete(obj.dirs, dir)
+		}
+	}
+}
+
 func isDir(path string) bool {
 	fInfo, err := os.Stat(path)
 	if err != nil {
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	errPathEscapes   = errors.New("path escapes base-dir")
+	errPathProtected = errors.New("protected path")
+)
+
+// windows的盘符、UNC路径
+var volumePathRegexp = regexp.MustCompile(`^([a-zA-Z]:|//|\\\\)`)
+
+// resolveSyncPath client传来的路径一律当作base-dir下的相对路径，
+// 含..、盘符，或者经过指向base-dir外的软链接的，都拒绝
+func (sp *serverProject) resolveSyncPath(clientPath string) (string, error) {
+	if strings.ContainsRune(clientPath, 0) || volumePathRegexp.MatchString(clientPath) {
+		return "", errPathEscapes
+	}
+	slashPath := formatFilePath(clientPath)
+	if volumePathRegexp.MatchString(slashPath) {
+		return "", errPathEscapes
+	}
+	for _, name := range strings.Split(slashPath, "/") {
+		if name == ".." {
+			return "", errPathEscapes
+		}
+	}
+	relativePath := strings.TrimPrefix(path.Clean("/"+slashPath), "/")
+	if relativePath == "" {
+		return "", errPathEscapes
+	}
+	if sp.isReservedPath(relativePath) {
+		return "", errPathProtected
+	}
+
+	baseDir, err := sp.realBaseDir()
+	if err != nil {
+		return "", err
+	}
+	filePath := filepath.Join(baseDir, filepath.FromSlash(relativePath))
+	// 最后一级不跟随：写入是rename覆盖，删除删的是链接本身；只检查上级目录
+	parentDir, err := evalExistingDir(filepath.Dir(filePath))
+	if err != nil {
+		return "", err
+	}
+	if !isSubPath(baseDir, parentDir) {
+		return "", errPathEscapes
+	}
+	// 经过base-dir内的软链接可能绕到受保护的路径，按解析后的真实路径再查一次
+	realRel, err := filepath.Rel(baseDir, filepath.Join(parentDir, filepath.Base(filePath)))
+	if err != nil {
+		return "", errPathEscapes
+	}
+	if sp.isReservedPath(filepath.ToSlash(realRel)) {
+		return "", errPathProtected
+	}
+	return filePath, nil
+}
+
+// isReservedPath 受保护的路径和server自己的暂存目录都不许client动
+func (sp *serverProject) isReservedPath(relativePath string) bool {
+	return sp.isProtectedPath(relativePath) || relativePath == stagingDirName || strings.HasPrefix(relativePath, stagingDirName+"/")
+}
+
+// checkLinkTarget 同步过来的软链接也不能指向base-dir外
+func (sp *serverProject) checkLinkTarget(filePath string, target string) error {
+	target = formatFilePath(target)
+	if path.IsAbs(target) || volumePathRegexp.MatchString(target) {
+		return errPathEscapes
+	}
+	baseDir, err := sp.realBaseDir()
+	if err != nil {
+		return err
+	}
+	parentDir, err := evalExistingDir(filepath.Dir(filePath))
+	if err != nil {
+		return err
+	}
+	resolved, err := resolveLinkTarget(parentDir, target)
+	if err != nil {
+		return err
+	}
+	if !isSubPath(baseDir, resolved) {
+		return errPathEscapes
+	}
+	return nil
+}
+
+// resolveLinkTarget 按系统的方式逐级解析链接目标：已存在的软链接先解析，再处理后面的..，
+// 不能直接filepath.Join，d/up/..在up是软链接时不等于d；
+// 还不存在的一级之后不允许再有..，否则以后补上一个软链接就能改变指向
+func resolveLinkTarget(dirPath string, target string) (string, error) {
+	resolved := dirPath
+	missing := false
+	for _, name := range strings.Split(target, "/") {
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			if missing {
+				return "", errPathEscapes
+			}
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+		resolved = filepath.Join(resolved, name)
+		if missing {
+			continue
+		}
+		realPath, err := filepath.EvalSymlinks(resolved)
+		if os.IsNotExist(err) {
+			missing = true
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		resolved = realPath
+	}
+	return resolved, nil
+}
+
+// checkMovedLinks 相对路径的软链接挪了位置指向就变了，rename之后重新检查，目录要检查里面所有的软链接
+func (sp *serverProject) checkMovedLinks(filePath string) error {
+	return filepath.Walk(filePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		return sp.checkLinkTarget(path, target)
+	})
+}
+
+// isServable http页面只提供base-dir里的文件，解析软链接后在base-dir外的不提供
+func (sp *serverProject) isServable(filePath string) bool {
+	baseDir, err := sp.realBaseDir()
+	if err != nil {
+		return false
+	}
+	realPath, err := filepath.EvalSymlinks(filePath)
+	return err == nil && isSubPath(baseDir, realPath)
+}
+
+func (sp *serverProject) realBaseDir() (string, error) {
+	baseDir, err := filepath.Abs(sp.baseDir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(baseDir)
+}
+
+// evalExistingDir 还没创建的目录里不会有软链接，解析到最深一级已存在的目录即可
+func evalExistingDir(dirPath string) (string, error) {
+	var missing []string
+	for {
+		realPath, err := filepath.EvalSymlinks(dirPath)
+		if err == nil {
+			for i := len(missing) - 1; i >= 0; i-- {
+				realPath = filepath.Join(realPath, missing[i])
+			}
+			return realPath, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(dirPath)
+		if parent == dirPath {
+			return "", err
+		}
+		missing = append(missing, filepath.Base(dirPath))
+		dirPath = parent
+	}
+}
+
+func isSubPath(baseDir string, filePath string) bool {
+	rel, err := filepath.Rel(baseDir, filePath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// isProtectedPath protected-paths里的文件、目录及其下的文件client不能覆盖、删除，支持通配符
+func (sp *serverProject) isProtectedPath(relativePath string) bool {
+	for _, protected := range sp.protectedPaths {
+		protected = strings.Trim(path.Clean("/"+formatFilePath(protected)), "/")
+		if protected == "" {
+			continue
+		}
+		if relativePath == protected || strings.HasPrefix(relativePath, protected+"/") {
+			return true
+		}
+		if matched, _ := path.Match(protected, relativePath); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// containsProtectedPath 删除、挪走目录前检查里面有没有受保护的文件
+func (sp *serverProject) containsProtectedPath(dirPath string) bool {
+	if len(sp.protectedPaths) == 0 {
+		return false
+	}
+	baseDir, err := sp.realBaseDir()
+	if err != nil {
+		return true
+	}
+	found := false
+	_ = filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || found {
+			return nil
+		}
+		rel, err := filepath.Rel(baseDir, path)
+		if err == nil && sp.isProtectedPath(filepath.ToSlash(rel)) {
+			found = true
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return found
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newSandboxProject(t *testing.T, protectedPaths ...string) (*serverProject, string) {
+	baseDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(baseDir, "conf"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return &serverProject{baseDir: baseDir, protectedPaths: protectedPaths}, baseDir
+}
+
+func TestResolveSyncPath(t *testing.T) {
+	sp, baseDir := newSandboxProject(t, "conf/secret.yml")
+	filePath, err := sp.resolveSyncPath("app/main.go")
+	if err != nil {
+		t.Fatalf("resolve app/main.go: %v", err)
+	}
+	realBase, _ := filepath.EvalSymlinks(baseDir)
+	if filePath != filepath.Join(realBase, "app", "main.go") {
+		t.Errorf("resolve app/main.go: got %s", filePath)
+	}
+
+	for _, clientPath := range []string{"../outside.txt", "app/../../outside.txt", `..\outside.txt`, "C:/Windows/win.ini", `C:\Windows\win.ini`, `\\host\share\a.txt`, "//host/share/a.txt"} {
+		if _, err := sp.resolveSyncPath(clientPath); err != errPathEscapes {
+			t.Errorf("resolve %s: expected errPathEscapes, got %v", clientPath, err)
+		}
+	}
+	for _, clientPath := range []string{"conf/secret.yml", "/conf/secret.yml", "./conf/secret.yml", ".syncds-tmp/a.tmp"} {
+		if _, err := sp.resolveSyncPath(clientPath); err != errPathProtected {
+			t.Errorf("resolve %s: expected errPathProtected, got %v", clientPath, err)
+		}
+	}
+}
+
+func TestResolveSyncPathSymlink(t *testing.T) {
+	sp, baseDir := newSandboxProject(t, "conf/secret.yml")
+	outside := t.TempDir()
+	// base-dir内指向受保护目录的软链接
+	if err := os.Symlink("conf", filepath.Join(baseDir, "alias")); err != nil {
+		t.Skipf("symlink not supported: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(baseDir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sp.resolveSyncPath("alias/secret.yml"); err != errPathProtected {
+		t.Errorf("resolve alias/secret.yml: expected errPathProtected, got %v", err)
+	}
+	if _, err := sp.resolveSyncPath("alias/other.yml"); err != nil {
+		t.Errorf("resolve alias/other.yml: %v", err)
+	}
+	for _, clientPath := range []string{"escape/a.txt", "escape/sub/a.txt"} {
+		if _, err := sp.resolveSyncPath(clientPath); err != errPathEscapes {
+			t.Errorf("resolve %s: expected errPathEscapes, got %v", clientPath, err)
+		}
+	}
+
+	filePath := filepath.Join(baseDir, "app", "link")
+	if err := sp.checkLinkTarget(filePath, "../conf/secret.yml"); err != nil {
+		t.Errorf("link to ../conf/secret.yml: %v", err)
+	}
+	for _, target := range []string{"../../outside.txt", outside, "C:/Windows"} {
+		if err := sp.checkLinkTarget(filePath, target); err != errPathEscapes {
+			t.Errorf("link to %s: expected errPathEscapes, got %v", target, err)
+		}
+	}
+}
+
+// 先同步d/up -> ..，再同步x -> d/up/..：按字面拼接在base-dir内，实际解析到base-dir的上一级
+func TestCheckLinkTargetThroughLink(t *testing.T) {
+	sp, baseDir := newSandboxProject(t)
+	if err := os.MkdirAll(filepath.Join(baseDir, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	upPath := filepath.Join(baseDir, "d", "up")
+	if err := sp.checkLinkTarget(upPath, ".."); err != nil {
+		t.Fatalf("link d/up -> ..: %v", err)
+	}
+	if err := os.Symlink("..", upPath); err != nil {
+		t.Skipf("symlink not supported: %v", err)
+	}
+	for _, target := range []string{"d/up/..", "d/up/../outside.txt", "d/up/up/.."} {
+		if err := sp.checkLinkTarget(filepath.Join(baseDir, "x"), target); err != errPathEscapes {
+			t.Errorf("link x -> %s: expected errPathEscapes, got %v", target, err)
+		}
+	}
+	if err := sp.checkLinkTarget(filepath.Join(baseDir, "x"), "d/up/conf"); err != nil {
+		t.Errorf("link x -> d/up/conf: %v", err)
+	}
+	// 还不存在的目录后面跟..，以后补上软链接就能逃出去
+	if err := sp.checkLinkTarget(filepath.Join(baseDir, "x"), "d/later/.."); err != errPathEscapes {
+		t.Errorf("link x -> d/later/..: expected errPathEscapes, got %v", err)
+	}
+}
+
+// 相对路径的软链接rename到更浅的位置后指向base-dir外，整批回滚
+func TestApplyRenameRechecksLinks(t *testing.T) {
+	session, baseDir := newApplySession(t)
+	if err := os.MkdirAll(filepath.Join(baseDir, "a", "b", "c"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../x", filepath.Join(baseDir, "a", "b", "L")); err != nil {
+		t.Skipf("symlink not supported: %v", err)
+	}
+	if err := os.Symlink("../../../x", filepath.Join(baseDir, "a", "b", "c", "L")); err != nil {
+		t.Fatal(err)
+	}
+
+	res := session.applyBatch([]FileMeta{{FilePath: "L", OldPath: "a/b/L", OptType: OptRename}})
+	if res.Error == "" {
+		t.Error("rename a/b/L -> L: expected rollback")
+	}
+	if _, err := os.Lstat(filepath.Join(baseDir, "L")); !os.IsNotExist(err) {
+		t.Errorf("L should not exist after rollback, err: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(baseDir, "a", "b", "L")); err != nil {
+		t.Errorf("a/b/L should be restored: %v", err)
+	}
+
+	// 目录里的软链接一起检查
+	res = session.applyBatch([]FileMeta{{FilePath: "b", OldPath: "a/b", OptType: OptRename}})
+	if res.Error == "" {
+		t.Error("rename a/b -> b: expected rollback")
+	}
+	if _, err := os.Lstat(filepath.Join(baseDir, "a", "b", "c", "L")); err != nil {
+		t.Errorf("a/b/c/L should be restored: %v", err)
+	}
+
+	// 挪到同一层级指向不变，允许
+	res = session.applyBatch([]FileMeta{{FilePath: "a/L2", OldPath: "a/b/L", OptType: OptRename}})
+	if res.Error != "" {
+		t.Errorf("rename a/b/L -> a/L2: %s", res.Error)
+	}
+}
@@ -1,46 +1,56 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
-	"crypto/md5"
 	"encoding/gob"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/bluele/gcache"
 	"github.com/gorilla/websocket"
-	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 )
 
 const (
 	OptWrite = iota
 	OptRemove
+	OptRename    // FilePath为新路径，OldPath为旧路径，文件、目录都可以
+	OptMkdir
+	OptRemoveDir // 递归删除目录
 )
 
 
 type FileMeta struct {
 	FilePath string
 	OptType int
-	Md5Code string
-	FileData []byte
+	Hash string // 握手时协商的hash算法
+	Size int64
+	// diff时server附上旧文件的分块签名，用于增量传输
+	Signature *DeltaSignature
+	// 保留的文件属性，为零值表示不同步该属性
+	Mode os.FileMode
+	ModTime time.Time
+	// 软链接的目标，不为空时不传内容，由server重建链接
+	LinkTarget string
+	// 内容一致只需要更新属性
+	AttrOnly bool
+	OldPath string
 }
 
-type fileMd5Meta struct {
-	Md5Code string
+type fileHashMeta struct {
+	Hash string
 	ModTime time.Time
 }
 
+const defaultHashCacheSize = 100000
+
 var upgrader  = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -48,26 +58,28 @@ var upgrader  = websocket.Upgrader{
 
 var (
 	serverConf ServerConf
-	md5Cache gcache.Cache
-	executingCmd *exec.Cmd
-	defaultConn *websocket.Conn
-	mut sync.Mutex
+	hashCache gcache.Cache
 )
 
 
 func serveWs(w http.ResponseWriter, r *http.Request) {
 	c, err := upgrader.Upgrade(w, r, nil)
-	defaultConn = c
 	if err != nil {
 		log.Print("websocket upgrade err:", err)
 		return
 	}
 	defer c.Close()
+	session := registerSession(c)
+	defer unregisterSession(session)
+	defer session.abortTransfers()
+	if !session.authenticate() {
+		return
+	}
 	for {
 		mt, reader, err := c.NextReader()
 		if err != nil {
-			log.Printf("read err: %v", err)
-			continue
+			log.Printf("session %d read err: %v", session.Id, err)
+			return
 		}
 		if mt == websocket.CloseMessage {
 			message, _ := ioutil.ReadAll(reader)
@@ -96,22 +108,106 @@ func serveWs(w http.ResponseWriter, r *http.Request) {
 
 				fileMetas := req.FileMetas
 				var needSyncs []FileMeta
+				// 本批改名的新路径 -> 旧路径，新路径下的文件对照旧文件比较
+				renames := make(map[string]string)
+				writes := make(map[string]bool)
+				for _, fileMeta := range fileMetas {
+					if fileMeta.OptType == OptWrite {
+						writes[fileMeta.FilePath] = true
+					}
+				}
 				for _, fileMeta := range fileMetas {
-					if fileMeta.OptType == OptRemove {
+					filePath, err := session.project.resolveSyncPath(fileMeta.FilePath)
+					if err != nil {
+						log.Printf(PreError + " diff, reject %s: %v", fileMeta.FilePath, err)
+						continue
+					}
+					switch fileMeta.OptType {
+					case OptRemove, OptRemoveDir:
 						needSyncs = append(needSyncs, fileMeta)
 						continue
+					case OptMkdir:
+						if !isDir(filePath) {
+							needSyncs = append(needSyncs, fileMeta)
+						}
+						continue
+					case OptRename:
+						oldPath, err := session.project.resolveSyncPath(fileMeta.OldPath)
+						if err != nil {
+							log.Printf(PreError + " diff, reject %s: %v", fileMeta.OldPath, err)
+							continue
+						}
+						if oldPath == filePath {
+							log.Printf(PreError + " diff, skip rename to the same path: %s", fileMeta.FilePath)
+							continue
+						}
+						if _, err := os.Lstat(oldPath); err == nil {
+							renames[filePath] = oldPath
+							needSyncs = append(needSyncs, fileMeta)
+						} else if fileMeta.Mode.IsDir() {
+							// server上没有旧目录(空目录或者从没同步过来)，直接建新目录，里面的文件各自按新增传输
+							if !isDir(filePath) {
+								needSyncs = append(needSyncs, FileMeta{FilePath: fileMeta.FilePath, OptType: OptMkdir})
+							}
+						} else if !writes[fileMeta.FilePath] {
+							// 没有旧文件可挪，改成传新文件
+							needSyncs = append(needSyncs, FileMeta{FilePath: fileMeta.FilePath, OptType: OptWrite})
+						}
+						continue
+					}
+					comparePath := renamedPath(renames, filePath)
+					if fileMeta.LinkTarget != "" {
+						if linkMatches(comparePath, fileMeta) {
+							log.Printf(PreLog + " diff, skip sync symlink: %s", fileMeta.FilePath)
+						} else {
+							needSyncs = append(needSyncs, fileMeta)
+						}
+						continue
+					}
+					// 大小不同不用再算hash
+					hashCode := ""
+					stat, err := os.Lstat(comparePath)
+					if err == nil && !stat.Mode().IsRegular() {
+						// server上是软链接之类的，要替换成普通文件
+						err = fmt.Errorf("%s is not a regular file", comparePath)
+					} else if err == nil && stat.Size() == fileMeta.Size {
+						// 对比hash
+						hashCode, err = calcFileHash(session.Hash, comparePath)
 					}
-					filePath := filepath.Join(serverConf.BaseDir, formatFilePath(fileMeta.FilePath))
-					// 对比md5
-					md5Code, err := calcFileMd5(filePath)
-					if err != nil || fileMeta.Md5Code != md5Code {
+					if err != nil || fileMeta.Hash != hashCode {
+						// 改名的文件传输时还没挪到新路径，不能做增量
+						if stat, err := os.Lstat(filePath); err == nil && comparePath == filePath && stat.Mode().IsRegular() && stat.Size() >= deltaMinFileSize {
+							fileMeta.Signature, err = calcSignature(session.Hash, filePath)
+							if err != nil {
+								log.Printf("calc signature of %s err: %v", filePath, err)
+							}
+						}
+						needSyncs = append(needSyncs, fileMeta)
+					} else if attrsDiffer(stat, fileMeta) {
+						fileMeta.AttrOnly = true
 						needSyncs = append(needSyncs, fileMeta)
 					} else {
 						log.Printf(PreLog + " diff, skip sync file: %s", fileMeta.FilePath)
 					}
 				}
 				syncFileMetasBytes, _ := json.Marshal(needSyncs)
-				writeJsonLocked("diffRes", string(syncFileMetasBytes))
+				session.writeJson("diffRes", string(syncFileMetasBytes))
+			case "manifest":
+				req := ManifestReq{}
+				err = gob.NewDecoder(bytes.NewBuffer(wsReqMsg.Data)).Decode(&req)
+				if err != nil {
+					log.Printf("read ManifestReq err: %v", err)
+					continue
+				}
+				session.handleManifest(req)
+			case "chunk":
+				req := ChunkReq{}
+				err = gob.NewDecoder(bytes.NewBuffer(wsReqMsg.Data)).Decode(&req)
+				if err != nil {
+					log.Printf("read ChunkReq err: %v", err)
+					continue
+				}
+				session.handleChunk(req)
 			case "sync":
 				req := SyncReq{}
 				err = gob.NewDecoder(bytes.NewBuffer(wsReqMsg.Data)).Decode(&req)
@@ -121,114 +217,105 @@ func serveWs(w http.ResponseWriter, r *http.Request) {
 				}
 				log.Printf(PreLog + " [ws] serve sync")
 
-				fileMetas := req.FileMetas
-				for _, fileMeta := range fileMetas {
-					filePath := filepath.Join(serverConf.BaseDir, formatFilePath(fileMeta.FilePath))
-					// 删文件
-					if fileMeta.OptType == OptRemove {
-						_, err = os.Lstat(filePath)
-						if err != nil {
-							log.Printf("remove file stat err: %v", err)
-							continue
-						}
-						err = os.Remove(filePath)
-						if err != nil {
-							w.WriteHeader(http.StatusBadRequest)
-							log.Printf("remove file err: %v", err)
-							continue
-						}
-						log.Println("file removed", filePath)
-						continue
-					}
-					// 创建父文件夹
-					fileDir := filepath.Dir(filePath)
-					_, err = os.Lstat(fileDir)
-					if os.IsNotExist(err) {
-						err = os.MkdirAll(fileDir, os.ModePerm)
-						if err != nil {
-							log.Printf("mkdir parent file err: %v", err)
-							continue
-						}
-					}
-					// 写文件
-					err = ioutil.WriteFile(filePath, fileMeta.FileData, os.ModePerm)
-					if err != nil {
-						log.Printf("WriteFile err: %v", err)
+				res := session.applyBatch(req.FileMetas)
+				resBytes, _ := json.Marshal(res)
+				session.writeJson("syncRes", string(resBytes))
+				if res.Error != "" {
+					// 整批回滚，不再deploy
+					log.Printf(PreError+" sync failed, rolled back, err: %s", res.Error)
+					continue
+				}
+				if req.DeployCmd != "" || len(req.DeploySteps) > 0 {
+					if err := session.project.checkDeploy(req); err != nil {
+						log.Printf(PreError+" session %d deploy rejected: %v", session.Id, err)
+						session.writeJson("deployRes", err.Error())
 						continue
 					}
-					log.Printf(PreLog + " sync, write file success: %s", fileMeta.FilePath)
-				}
-				if req.DeployCmd != "" {
-					go execDeploy(req.DeployCmd, req.DeployKillCmd)
+					go session.project.execDeploy(req)
 				}
 			}
 		}
 	}
 }
 
-func writeJsonLocked(typ string, data string) {
-	mut.Lock()
-	defer mut.Unlock()
-	_ = defaultConn.WriteJSON(WsResMessage{
-		typ,
-		data,
-	})
-}
-
-func execDeploy(deployCmd string, deployKillCmd string) {
-	if executingCmd != nil {
-		err := executingCmd.Process.Kill()
-		if err != nil {
-			writeJsonLocked("syncRes", "kill failed, err:" + err.Error())
-			log.Println("kill failed, err:" + err.Error())
-			if deployKillCmd != "" {
-				_ = exec.Command("sh", "-c", deployKillCmd).Start()
-			}
-		} else {
-			writeJsonLocked("syncRes", "kill success")
-			log.Println("kill success")
-		}
+// execDeploy 按顺序执行deploy的各个步骤；新的deploy会取消还在执行的流水线，先停掉上次的服务进程组再开始
+func (sp *serverProject) execDeploy(req SyncReq) {
+	run := &pipelineRun{
+		sp:           sp,
+		pipeline:     len(req.DeploySteps) > 0,
+		healthChecks: req.HealthChecks,
+	}
+	steps := req.DeploySteps
+	if !run.pipeline {
+		steps = []DeployStep{{Cmd: req.DeployCmd, Service: true}}
 	}
 
-	// fix start failed after kill
-	time.Sleep(time.Duration(2) * time.Second)
-
-	executingCmd = exec.Command("sh", "-c", deployCmd)
-	stdout, _ := executingCmd.StdoutPipe()
-	stderr, _ := executingCmd.StderrPipe()
-	err := executingCmd.Start()
-	if err != nil {
-		writeJsonLocked("syncRes", "cmd start failed, err:" + err.Error())
-		log.Println("cmd start failed, err:" + err.Error())
+	sp.mut.Lock()
+	if sp.pipelineCancel != nil {
+		close(sp.pipelineCancel)
+	}
+	run.cancel = make(chan struct{})
+	sp.pipelineCancel = run.cancel
+	sp.mut.Unlock()
+	sp.pipelineMut.Lock()
+	defer sp.pipelineMut.Unlock()
+	if run.cancelled() {
+		// 等待期间又来了新的deploy
 		return
 	}
-	writeJsonLocked("syncRes", "cmd start success")
-	log.Println("cmd start success")
 
-	stdoutScanner := bufio.NewScanner(stdout)
-	stdoutScanner.Split(bufio.ScanLines)
-	for stdoutScanner.Scan() {
-		line := stdoutScanner.Text()
-		writeJsonLocked("deployStdout", line)
-		fmt.Printf( "[stdout] %s\n", line)
-	}
+	sp.mut.Lock()
+	// 旧进程组真正退出、端口释放后才开始
+	sp.stopDeploy(req.DeployKillCmd)
+	sp.mut.Unlock()
 
-	stderrScanner := bufio.NewScanner(stderr)
-	stderrScanner.Split(bufio.ScanLines)
-	for stderrScanner.Scan() {
-		line := stderrScanner.Text()
-		writeJsonLocked("deployStderr", line)
-		fmt.Printf("[stderr] %s\n", line)
+	res := PipelineRes{Success: true}
+	aborted := false
+	for i, step := range steps {
+		if run.pipeline && step.Name == "" {
+			step.Name = fmt.Sprintf("step%d", i+1)
+		}
+		stepRes := DeployStepRes{Index: i + 1, Total: len(steps), Name: step.Name, Status: StepRunning}
+		if aborted {
+			stepRes.Status = StepSkipped
+			res.Steps = append(res.Steps, stepRes)
+			run.sendStep(stepRes)
+			continue
+		}
+		run.sendStep(stepRes)
+		if run.pipeline {
+			log.Printf(PreLog+" deploy step %d/%d %s: %s", stepRes.Index, stepRes.Total, step.Name, step.Cmd)
+		}
+		start := time.Now()
+		var err error
+		if step.Service {
+			err = run.startService(step)
+		} else {
+			err = run.runStep(step)
+		}
+		stepRes.Elapsed = time.Since(start)
+		stepRes.Status = StepOk
+		if err != nil {
+			stepRes.Status = StepFailed
+			stepRes.Detail = err.Error()
+			res.Success = false
+			if err == errPipelineCancelled || step.OnFailure != OnFailureContinue {
+				aborted = true
+			}
+			if run.pipeline {
+				log.Printf(PreError+" deploy step %s failed, err: %v", step.Name, err)
+			}
+		}
+		res.Steps = append(res.Steps, stepRes)
+		run.sendStep(stepRes)
 	}
-
-	err = executingCmd.Wait()
-	if err != nil {
-		writeJsonLocked("syncRes", "cmd exec failed, err:" + err.Error())
-		log.Printf("cmd exec failed, err:" + err.Error())
+	if run.pipeline {
+		log.Printf(PreLog+" deploy pipeline of `%s` done, success: %t", sp.label(), res.Success)
+		resBytes, _ := json.Marshal(res)
+		sp.broadcastJson("pipelineRes", string(resBytes))
 	}
 }
 
-
 func serveDir(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		return
@@ -237,7 +324,17 @@ func serveDir(w http.ResponseWriter, r *http.Request) {
 	if strings.HasPrefix(urlPath, "/") {
 		urlPath = strings.Replace(urlPath, "/", "", 1)
 	}
-	filePath := filepath.Join(serverConf.BaseDir, urlPath)
+	sp, projectPath := httpProject(urlPath)
+	if sp == nil {
+		if projectPath != "" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = fmt.Fprintf(w, "project not found: %s", projectPath)
+			return
+		}
+		genProjectIndex(w)
+		return
+	}
+	filePath := filepath.Join(sp.baseDir, projectPath)
 	log.Println("filePath", filePath)
 	stat, err := os.Lstat(filePath)
 	if err != nil {
@@ -245,6 +342,11 @@ func serveDir(w http.ResponseWriter, r *http.Request) {
 		_, _ = fmt.Fprintf(w, "file or dir not found: %s", filePath)
 		return
 	}
+	if !sp.isServable(filePath) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = fmt.Fprintf(w, "link outside base-dir: %s", projectPath)
+		return
+	}
 	if !stat.IsDir() {
 		http.ServeFile(w, r, filePath)
 		return
@@ -252,64 +354,91 @@ func serveDir(w http.ResponseWriter, r *http.Request) {
 	GenDirIndex(w, filePath, urlPath)
 }
 
-func calcFileMd5(filePath string) (string, error) {
+// calcFileHash 不同session可能协商了不同算法，缓存按算法区分
+func calcFileHash(algo string, filePath string) (string, error) {
 	fileStat, err := os.Lstat(filePath)
 	if err == nil && !fileStat.IsDir() {
-		md5Meta := fileMd5Meta{}
-		md5MetaI, err :=  md5Cache.Get(filePath)
-		if err == nil && md5MetaI != nil {
-			md5Meta = md5MetaI.(fileMd5Meta)
+		cacheKey := algo + ":" + filePath
+		hashMeta := fileHashMeta{}
+		hashMetaI, err :=  hashCache.Get(cacheKey)
+		if err == nil && hashMetaI != nil {
+			hashMeta = hashMetaI.(fileHashMeta)
 		}
-		if err != nil || !fileStat.ModTime().Equal(md5Meta.ModTime) {
-			existFile, err := os.Open(filePath)
+		if err != nil || !fileStat.ModTime().Equal(hashMeta.ModTime) {
+			log.Printf("calc %s of file %s", algo, filePath)
+			_, hashCode, err := hashFile(algo, filePath)
 			if err != nil {
 				return "", nil
 			}
-			log.Printf("calc md5 of file %s", filePath)
-			md5hash := md5.New()
-			_, _ = io.Copy(md5hash, existFile)
-			md5Code := hex.EncodeToString(md5hash.Sum(nil))
-			md5Meta.Md5Code = md5Code
-			md5Meta.ModTime = fileStat.ModTime()
-			err = md5Cache.Set(filePath, md5Meta)
+			hashMeta.Hash = hashCode
+			hashMeta.ModTime = fileStat.ModTime()
+			err = hashCache.Set(cacheKey, hashMeta)
 			if err != nil {
 				return "", err
 			}
 		}
-		return md5Meta.Md5Code, nil
+		return hashMeta.Hash, nil
 	}
 	return "", nil
 }
 
 func handleInterrupt() {
 	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt, os.Kill)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 
 	<-interrupt
 	log.Println("interrupt")
-	if executingCmd != nil {
-		err := executingCmd.Process.Kill()
-		if err != nil {
-			writeJsonLocked("syncRes", "interrupt, kill failed, err:" + err.Error())
-			log.Println("interrupt, kill failed, err:" + err.Error())
-		} else {
-			writeJsonLocked("syncRes", "interrupt, kill success")
-			log.Println("interrupt, kill success")
+	// deploy进程在单独的进程组里，收不到终端的Ctrl+C和发给server的SIGTERM，要主动停掉
+	for _, sp := range allServerProjects() {
+		sp.mut.Lock()
+		if sp.stepProcess != nil {
+			sp.terminateProcess(sp.stepProcess, "")
 		}
+		sp.stopDeploy("")
+		sp.mut.Unlock()
 	}
 	os.Exit(2)
 }
 
 func StartServer(conf ServerConf) {
 	serverConf = conf
-	md5Cache = gcache.New(100).LFU().Build()
+	// merkle树要用到所有文件的hash，缓存要能放下整个base-dir
+	cacheSize := serverConf.HashCacheSize
+	if cacheSize <= 0 {
+		cacheSize = defaultHashCacheSize
+	}
+	hashCache = gcache.New(cacheSize).LFU().Build()
+	err := initServerProjects(serverConf)
+	if err != nil {
+		log.Fatalf("load projects failed, err: %v", err)
+	}
 
 	go handleInterrupt()
-	http.HandleFunc("/", serveDir)
+	if serverConf.Secret == "" {
+		log.Printf(PreError + " no secret configured in %s, anyone who can reach %s can sync files and run deploy commands", fileNameServerConfig, serverConf.Server)
+	}
+	if !serverConf.Tls && hasHttpPassword() {
+		log.Printf(PreError + " http-password is sent in cleartext without tls, please enable tls")
+	}
+	http.HandleFunc("/", requireHttpPassword(serveDir))
 	http.HandleFunc("/ws", serveWs)
 
-	log.Printf("server run at %s", serverConf.Server)
-	err := http.ListenAndServe(serverConf.Server, nil)
+	if serverConf.Tls {
+		var certFile, keyFile string
+		certFile, keyFile, err = ensureServerCert(serverConf)
+		if err != nil {
+			log.Fatalf("prepare tls cert failed, err: %v", err)
+		}
+		err = logCertFingerprint(certFile, keyFile)
+		if err != nil {
+			log.Fatalf("load tls cert failed, err: %v", err)
+		}
+		log.Printf("server run at https://%s", serverConf.Server)
+		err = http.ListenAndServeTLS(serverConf.Server, certFile, keyFile, nil)
+	} else {
+		log.Printf("server run at %s", serverConf.Server)
+		err = http.ListenAndServe(serverConf.Server, nil)
+	}
 	if err != nil {
 		log.Fatalf("server run at %s, failed. please check the config-file/server", serverConf.Server)
 	}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Session 每个ws连接一个session，diff、sync的回复只发给发起请求的连接
+type Session struct {
+	Id    int64
+	Codec string // 握手时协商的压缩算法
+	Hash  string // 握手时协商的hash算法
+	// 认证通过的项目，补发完最近的输出后才订阅该项目的deploy输出
+	project    *serverProject
+	subscribed bool
+	conn       *websocket.Conn
+	// 发送队列，只有写协程写连接，调用方不会被慢client卡住
+	send      chan WsResMessage
+	done      chan struct{}
+	writeDone chan struct{}
+	closeOnce sync.Once
+	// 正在接收的分片文件，只在该连接的读协程里访问
+	transfers map[int64]*transfer
+	// 已经收完、等待sync请求提交的临时文件，key为目标路径
+	staged map[string]stagedFile
+	// 对账时按client的文件清单建的hash树，只在读协程里访问
+	manifest *merkleNode
+}
+
+const (
+	sessionSendQueue = 1024
+	// 队列满时最多等这么久，一直腾不出位置说明client卡住了，直接断开
+	sessionEnqueueTimeout = 2 * time.Second
+	// 单条消息的写超时
+	sessionWriteTimeout = 10 * time.Second
+)
+
+var (
+	sessionMut    sync.Mutex
+	sessions      = make(map[int64]*Session)
+	lastSessionId int64
+)
+
+func registerSession(conn *websocket.Conn) *Session {
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	lastSessionId++
+	session := &Session{
+		Id:        lastSessionId,
+		conn:      conn,
+		send:      make(chan WsResMessage, sessionSendQueue),
+		done:      make(chan struct{}),
+		writeDone: make(chan struct{}),
+		transfers: make(map[int64]*transfer),
+		staged:    make(map[string]stagedFile),
+	}
+	sessions[session.Id] = session
+	go session.writeLoop()
+	log.Printf(PreLog+" session %d connected from %s", session.Id, conn.RemoteAddr())
+	return session
+}
+
+// unregisterSession 等写协程把队列里剩下的消息发完再返回，之后才关闭连接
+func unregisterSession(session *Session) {
+	sessionMut.Lock()
+	delete(sessions, session.Id)
+	sessionMut.Unlock()
+	close(session.done)
+	<-session.writeDone
+	log.Printf(PreLog+" session %d closed", session.Id)
+}
+
+// subscribe 订阅项目的deploy输出
+func (session *Session) subscribe() {
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	session.subscribed = true
+	log.Printf(PreLog+" session %d subscribed to project `%s`", session.Id, session.project.label())
+}
+
+// writeJson 放入发送队列就返回，不做网络io；队列满时短暂等待，等不到就断开这个client
+func (session *Session) writeJson(typ string, data string) {
+	msg := WsResMessage{typ, data}
+	select {
+	case session.send <- msg:
+		return
+	case <-session.done:
+		return
+	default:
+	}
+	timer := time.NewTimer(sessionEnqueueTimeout)
+	defer timer.Stop()
+	select {
+	case session.send <- msg:
+	case <-session.done:
+	case <-timer.C:
+		session.drop("send queue full")
+	}
+}
+
+// writeLoop 按入队顺序发出消息；session注销后把剩下的在一个写超时内发完
+func (session *Session) writeLoop() {
+	defer close(session.writeDone)
+	for {
+		select {
+		case msg := <-session.send:
+			if !session.write(msg, time.Now().Add(sessionWriteTimeout)) {
+				return
+			}
+		case <-session.done:
+			deadline := time.Now().Add(sessionWriteTimeout)
+			for {
+				select {
+				case msg := <-session.send:
+					if !session.write(msg, deadline) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (session *Session) write(msg WsResMessage, deadline time.Time) bool {
+	_ = session.conn.SetWriteDeadline(deadline)
+	if err := session.conn.WriteJSON(msg); err != nil {
+		log.Printf("session %d write err: %v", session.Id, err)
+		session.drop("write failed")
+		return false
+	}
+	return true
+}
+
+// drop 关闭连接，读协程随之出错退出并注销session
+func (session *Session) drop(reason string) {
+	session.closeOnce.Do(func() {
+		log.Printf(PreError+" session %d dropped: %s", session.Id, reason)
+		_ = session.conn.Close()
+	})
+}
+
+// broadcastJson 发给订阅了该项目的所有session；按server上的项目而不是client报的名字区分
+func (sp *serverProject) broadcastJson(typ string, data string) {
+	sessionMut.Lock()
+	var subscribers []*Session
+	for _, session := range sessions {
+		if session.subscribed && session.project == sp {
+			subscribers = append(subscribers, session)
+		}
+	}
+	sessionMut.Unlock()
+
+	for _, session := range subscribers {
+		session.writeJson(typ, data)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultStopGraceMs = 5000
+	// SIGKILL后进程组还在时再等多久
+	killWaitTimeout = 5 * time.Second
+	// 旧进程退出后等端口释放的最长时间
+	portFreeTimeout = 30 * time.Second
+)
+
+// deployProcess 一次deploy启动的进程组，sh是组长
+type deployProcess struct {
+	cmd      *exec.Cmd
+	exited   chan struct{} // sh退出、输出读完后关闭
+	stopping chan struct{} // 主动停止时关闭，退出不算失败
+}
+
+func startDeployProcess(cmd *exec.Cmd) (*deployProcess, error) {
+	setProcessGroup(cmd)
+	err := cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return &deployProcess{
+		cmd:      cmd,
+		exited:   make(chan struct{}),
+		stopping: make(chan struct{}),
+	}, nil
+}
+
+// running sh还没退出，或者它启动的子进程还在
+func (process *deployProcess) running() bool {
+	select {
+	case <-process.exited:
+		return processGroupAlive(process.cmd)
+	default:
+		return true
+	}
+}
+
+func (process *deployProcess) stopped() bool {
+	select {
+	case <-process.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitExit 等到进程组全部退出，超时返回false
+func (process *deployProcess) waitExit(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for process.running() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+// stopDeploy 调用方持有sp.mut；停掉上次deploy的服务进程组，再等deploy-ports释放
+func (sp *serverProject) stopDeploy(deployKillCmd string) {
+	if sp.process == nil || !sp.process.running() {
+		return
+	}
+	sp.terminateProcess(sp.process, deployKillCmd)
+	sp.waitPortsFree()
+}
+
+// terminateProcess 调用方持有sp.mut；先SIGTERM整个进程组，grace后还没退出再SIGKILL，
+// 仍然停不掉时执行deploy-kill-cmd兜底
+func (sp *serverProject) terminateProcess(process *deployProcess, deployKillCmd string) {
+	if !process.running() || process.stopped() {
+		return
+	}
+	close(process.stopping)
+	pid := process.cmd.Process.Pid
+	err := signalProcessGroup(process.cmd, false)
+	if err != nil {
+		log.Printf(PreError+" terminate process group %d err: %v", pid, err)
+	}
+	sp.broadcastJson("deployRes", fmt.Sprintf("stopping, wait up to %v", sp.stopGrace))
+	if process.waitExit(sp.stopGrace) {
+		sp.broadcastJson("deployRes", "stop success")
+		log.Printf(PreLog+" process group %d stopped", pid)
+	} else {
+		log.Printf(PreLog+" process group %d still running after %v, kill", pid, sp.stopGrace)
+		err = signalProcessGroup(process.cmd, true)
+		if err == nil && process.waitExit(killWaitTimeout) {
+			sp.broadcastJson("deployRes", "kill success")
+			log.Printf(PreLog+" process group %d killed", pid)
+		} else {
+			if err == nil {
+				err = fmt.Errorf("still running after %v", killWaitTimeout)
+			}
+			sp.broadcastJson("deployRes", "kill failed, err:"+err.Error())
+			log.Printf(PreError+" kill process group %d failed, err: %v", pid, err)
+			if deployKillCmd != "" {
+				log.Printf(PreLog+" exec deploy kill cmd: %s", deployKillCmd)
+				_ = exec.Command("sh", "-c", deployKillCmd).Run()
+			}
+		}
+	}
+}
+
+// waitPortsFree 服务停了端口不一定马上能用，能listen才算释放
+func (sp *serverProject) waitPortsFree() {
+	deadline := time.Now().Add(portFreeTimeout)
+	for _, port := range sp.deployPorts {
+		for !portFree(port) {
+			if time.Now().After(deadline) {
+				log.Printf(PreError+" port %d still in use after %v", port, portFreeTimeout)
+				sp.broadcastJson("deployRes", fmt.Sprintf("port %d still in use", port))
+				return
+			}
+			time.Sleep(200 * time.Millisecond)
+		}
+	}
+}
+
+func portFree(port int) bool {
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return false
+	}
+	_ = listener.Close()
+	return true
+}
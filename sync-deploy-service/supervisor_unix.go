@@ -0,0 +1,69 @@
+//go:build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// setProcessGroup deploy命令单独一个进程组，停止时连同sh启动的java等子进程一起停
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func signalProcessGroup(cmd *exec.Cmd, force bool) error {
+	sig := syscall.SIGTERM
+	if force {
+		sig = syscall.SIGKILL
+	}
+	err := syscall.Kill(-cmd.Process.Pid, sig)
+	if err == syscall.ESRCH {
+		return nil
+	}
+	return err
+}
+
+func processGroupAlive(cmd *exec.Cmd) bool {
+	pgid := cmd.Process.Pid
+	err := syscall.Kill(-pgid, 0)
+	if err != nil && err != syscall.EPERM {
+		return false
+	}
+	// 容器里没有init回收时，退出的子进程一直是僵尸进程，不算还在运行
+	if alive, ok := groupHasLiveProcess(pgid); ok {
+		return alive
+	}
+	return true
+}
+
+// groupHasLiveProcess 从/proc里找进程组里不是僵尸的进程，没有/proc(如macOS)时ok为false
+func groupHasLiveProcess(pgid int) (alive bool, ok bool) {
+	files, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return false, false
+	}
+	pgidStr := strconv.Itoa(pgid)
+	for _, file := range files {
+		if _, err := strconv.Atoi(file.Name()); err != nil {
+			continue
+		}
+		stat, err := ioutil.ReadFile("/proc/" + file.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		// pid (comm) state ppid pgrp ...，comm里可能有空格和括号
+		end := strings.LastIndexByte(string(stat), ')')
+		if end < 0 {
+			continue
+		}
+		fields := strings.Fields(string(stat[end+1:]))
+		if len(fields) >= 3 && fields[2] == pgidStr && fields[0] != "Z" {
+			return true, true
+		}
+	}
+	return false, true
+}
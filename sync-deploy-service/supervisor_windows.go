@@ -0,0 +1,31 @@
+//go:build windows
+
+package main
+
+import (
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// signalProcessGroup windows没有SIGTERM，用taskkill结束进程树，force时加/F
+func signalProcessGroup(cmd *exec.Cmd, force bool) error {
+	args := []string{"/T", "/PID", strconv.Itoa(cmd.Process.Pid)}
+	if force {
+		args = append([]string{"/F"}, args...)
+	}
+	err := exec.Command("taskkill", args...).Run()
+	if err != nil && force {
+		return cmd.Process.Kill()
+	}
+	return nil
+}
+
+// processGroupAlive 取不到进程树的状态，以sh退出为准
+func processGroupAlive(cmd *exec.Cmd) bool {
+	return false
+}
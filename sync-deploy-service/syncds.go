@@ -13,10 +13,20 @@ import (
 const tplClientConfig = `
 # ip、端口 与server.yml一致
 server: 127.0.0.1:8003
+# 选填，同时同步到多台server，每台单独连接、diff、deploy，日志前带上name；填了servers时忽略server
+# servers:
+#   - name: test1
+#     server: 10.0.0.1:8003
+#   - name: test2
+#     server: 10.0.0.2:8003
+#     secret: other-secret
+#     tls-fingerprint: AB:CD:...
 # 同步范围的root文件夹，建议将配置文件放在代码库根目录，base-dir: ./
 base-dir: ./
-# 监听触发间隔时间，毫秒
+# 改动静默多久后触发同步，毫秒，同一文件的多次改动合并成一次
 interval-ms: 3000
+# 选填，一直有改动时最多等多久也要同步一次，毫秒，默认10000
+# max-latency-ms: 10000
 # 监听哪些文件、文件夹，相对与base-dir的路径
 include-paths:
   - ./xx-app/target/xx-app.jar
@@ -28,12 +38,70 @@ include-paths:
 include-file-regexp: \.(yml|properties|jar)$
 # 选填，用正则排除path，如idea编辑器的临时文件 ___jb_tmp___, ___jb_old___
 exclude-path-regexp: (__)$
+# 选填，base-dir及子目录下的.syncdsignore按gitignore语法忽略文件(支持!、/结尾只匹配目录、**)；
+# 开启后也读取项目里的.gitignore，同一目录下.syncdsignore优先；修改忽略文件后重启client生效
+# use-gitignore: true
 # 选填，触发deploy的path正则，如果不填则所有文件改动都触发deploy
 deploy-path-regexp: \.jar$
 # 部署脚本、重启服务命令，支持本地实时滚动deploy命令的stdout、stderr
 # deploy-cmd: "ps -ef|grep xx-app.jar|awk '{print $2}'|xargs kill -9; java -jar xx-app/target/xx-app.jar"
 # deploy-cmd: "java -agentlib:jdwp=transport=dt_socket,server=y,suspend=n,address=8644 -jar target/bard-admin-0.0.1-SNAPSHOT.jar"
 deploy-cmd: "java -jar xx-app/target/xx-app.jar"
+# 选填，server停不掉上次deploy的进程组时执行的兜底命令
+# deploy-kill-cmd: "ps -ef|grep xx-app.jar|awk '{print $2}'|xargs kill -9"
+# 选填，deploy启动后由server执行的健康检查，http(GET，期望status，默认200)、tcp(端口能连上)、log-regexp(deploy输出里出现匹配的行)填一个，
+# 各自在timeout-ms(默认30000)内通过才算healthy，结果打印在本地
+# health-checks:
+#   - http: http://127.0.0.1:8080/actuator/health
+#     status: 200
+#     timeout-ms: 60000
+#   - tcp: 127.0.0.1:8644
+#   - name: started
+#     log-regexp: Started \w+Application
+# 选填，多步骤deploy，按顺序执行，填了deploy-steps时不再执行deploy-cmd；每步的输出带上步骤名，本地打印每一步的进度和最终结果
+# service: true的是要一直运行的服务(最多一个)，启动后(配了health-checks时等检查通过)就执行下一步，下次deploy时停止；
+# 其他步骤执行到退出为止，超过timeout-ms(默认300000)停止并算失败；失败时on-failure: abort(默认)跳过后面的步骤，continue继续执行
+# deploy-steps:
+#   - name: build
+#     cmd: "mvn -q package -DskipTests"
+#   - name: migrate
+#     cmd: "sh migrate.sh"
+#     timeout-ms: 60000
+#     on-failure: continue
+#   - name: start
+#     cmd: "java -jar xx-app/target/xx-app.jar"
+#     service: true
+#   - name: smoke-test
+#     cmd: "curl -sf http://127.0.0.1:8080/ping"
+# 选填，与syncds-server.yml的secret一致，用于连接server时的签名认证
+# secret: change-me
+# 选填，server配置了projects时要同步的项目名，不填时用name；servers里也可以每台单独填project
+# project: order-service
+# 选填，使用wss连接server（也可以直接写server: wss://ip:port），需填写server启动日志里打印的证书指纹
+# tls: true
+# tls-fingerprint: AB:CD:...
+# 选填，传输压缩算法，按优先级与server协商，默认[zstd, gzip]，填[none]不压缩；jar、zip、png等已压缩的文件不会再压缩
+# compress: [zstd, gzip]
+# 选填，不同步的文件属性，可选mode(权限)、mtime(修改时间)、symlink(软链接按链接同步，不填则传链接指向的内容)；windows默认不同步mode
+# skip-attrs: [mode]
+# 选填，文件hash算法，按优先级与server协商，默认[xxhash, sha256]；xxhash最快，只用于判断文件是否改动；md5需要双方都显式填写
+# hash: [xxhash, sha256]
+# 选填，一个client同时跑多个服务，每个profile单独watch、连接server、deploy；没填的项沿用上面的配置，
+# 没填project时name即server上的项目名；disabled: true默认不启动，命令行 -p a,b 只启动指定的，--disable c 跳过指定的
+# profiles:
+#   - name: user-service
+#     base-dir: ./user-service
+#     include-paths:
+#       - ./target/user-service.jar
+#     deploy-cmd: "java -jar target/user-service.jar"
+#   - name: order-service
+#     base-dir: ./order-service
+#     server: 10.0.0.2:8003
+#     include-paths:
+#       - ./target/order-service.jar
+#     deploy-path-regexp: \.jar$
+#     deploy-cmd: "java -jar target/order-service.jar"
+#     disabled: true
 `
 
 const tplServerConfig = `
@@ -43,6 +111,53 @@ server: 127.0.0.1:8003
 base-dir: ./
 # 是否开启http服务http://server，列出base-dir目录，方便查看文件列表及更新时间等
 show-dir-list: true
+# 强烈建议填写，client需配置相同的secret才能同步文件、执行deploy
+# secret: change-me
+# 选填，目录列表页面用basic auth访问的密码，不要和secret相同，建议同时开启tls；配了secret但不填时目录列表页面不开放
+# http-password: change-me-too
+# 选填，开启https/wss；证书文件不存在时自动生成自签名证书并保存，启动日志会打印证书指纹
+# tls: true
+# tls-cert-file: syncds-server.crt
+# tls-key-file: syncds-server.key
+# 选填，允许client使用的压缩算法，默认[zstd, gzip]，填[none]不压缩
+# compress: [zstd, gzip]
+# 选填，文件hash缓存条数，用于diff和目录hash树，默认100000，建议不小于base-dir下的文件数
+# hash-cache-size: 100000
+# 选填，不接受的文件属性，可选mode、mtime、symlink
+# skip-attrs: [mode]
+# 选填，受保护的路径(相对base-dir，支持*通配符)，client不能覆盖、删除，如server上独有的配置文件
+# protected-paths:
+#   - app/config/application-prod.yml
+#   - app/logs
+# 选填，允许client使用的hash算法，默认[xxhash, sha256]，md5要显式填写才允许；需要校验文件完整性时只填[sha256]
+# hash: [sha256]
+# 选填，只允许执行这些deploy命令(client的deploy-cmd、deploy-kill-cmd要完全一致)，不填不限制
+# deploy-cmds:
+#   - "sh restart.sh"
+# 选填，允许client使用的http、tcp健康检查(http的url、tcp的地址要一致)；配了deploy-cmds或health-checks时，不在列表里的检查会被拒绝
+# health-checks:
+#   - http: http://127.0.0.1:8080/actuator/health
+#   - tcp: 127.0.0.1:8644
+# 选填，deploy命令在单独的进程组里运行，下次deploy前先SIGTERM整个进程组，等待stop-grace-ms(默认5000)后还没退出再SIGKILL
+# stop-grace-ms: 5000
+# 选填，服务监听的端口，旧进程退出后等这些端口释放再启动新的deploy
+# deploy-ports: [8080]
+# 选填，每个项目在内存里保留最近多少行deploy输出，默认1000；新连上的client先补发最近deploy-log-replay行(默认100)，断线重连的client从断开处接着补发
+# deploy-log-lines: 1000
+# deploy-log-replay: 100
+# 选填，一个server同步多个项目，每个项目有自己的base-dir、secret、deploy-cmds和deploy进程；
+# 配置后client要用project(不填时为name)指定项目，上面的base-dir不再使用，目录列表页面第一级为项目名
+# projects:
+#   - name: order-service
+#     base-dir: /data/order-service
+#     deploy-cmds: ["java -jar target/order-service.jar"]
+#     health-checks: [{http: "http://127.0.0.1:8080/actuator/health"}]
+#     deploy-ports: [8080]
+#   - name: user-service
+#     base-dir: /data/user-service
+#     secret: other-secret
+#     http-password: other-password
+#     protected-paths: [config/application-prod.yml]
 `
 
 const fileNameClientConfig = "syncds-client.yml"
@@ -54,6 +169,8 @@ func main() {
 	var name string
 	var isStart bool
 	var isInit bool
+	var enabledProfiles []string
+	var disabledProfiles []string
 
 	var cmdClient = &cobra.Command{
 		Use:   "client",
@@ -78,7 +195,10 @@ func main() {
 			} else if isStart {
 				var conf ClientConf
 				conf.getConf()
-				StartClient(conf)
+				if conf.Name == "" {
+					conf.Name = name
+				}
+				StartClient(conf, enabledProfiles, disabledProfiles)
 				log.Printf("syncds client start with name %s", name)
 			}
 		},
@@ -86,6 +206,8 @@ func main() {
 	cmdClient.Flags().StringVarP(&name, "name", "n", "", "uniq serve name")
 	cmdClient.Flags().BoolVarP(&isStart, "start", "s", true, "start serving")
 	cmdClient.Flags().BoolVarP(&isInit, "init", "i", false, "init config")
+	cmdClient.Flags().StringSliceVarP(&enabledProfiles, "profile", "p", nil, "only run these profiles, e.g. -p user,order")
+	cmdClient.Flags().StringSliceVar(&disabledProfiles, "disable", nil, "skip these profiles")
 	_ = cmdClient.MarkFlagRequired("name")
 
 	var cmdServer = &cobra.Command{
@@ -127,7 +249,8 @@ func main() {
 		Long: `stop a client or server running before`,
 		Args: cobra.MinimumNArgs(0),
 		Run: func(cmd *cobra.Command, args []string) {
-			kill := "ps -ef | grep 'syncds' | grep '" + name + "' | awk '{print $2}' | xargs kill -9"
+			// 用SIGTERM，server退出前会先停掉deploy的进程组
+			kill := "ps -ef | grep 'syncds' | grep '" + name + "' | awk '{print $2}' | xargs kill"
 			log.Println(kill)
 
 			var stdout bytes.Buffer
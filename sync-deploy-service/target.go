@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	targetConnecting = "connecting"
+	targetSyncing    = "syncing"
+	targetUpToDate   = "up to date"
+	targetOffline    = "offline"
+	targetFailed     = "failed"
+)
+
+// syncTarget 一台要同步的server，连接、协商结果、对账状态、diff和deploy结果各自独立
+type syncTarget struct {
+	profile        *syncProfile
+	name           string
+	server         string
+	project        string // 握手时告诉server要同步的项目
+	secret         string
+	tls            bool
+	tlsFingerprint string
+	log            *log.Logger
+	messageChan    chan WsReqMessage
+	// 连接、对账状态，对账完成前的改动暂存在offlineChanges
+	connMut        sync.Mutex
+	online         bool
+	codec          string
+	hashAlgo       string
+	offlineChanges map[string]FileMeta
+	rejected       bool // server拒绝了认证，不再连接
+	// 收到的最后一行deploy输出，重连时让server接着补发
+	logEpoch      int64
+	lastDeploySeq int64
+	// 汇总用的同步、deploy状态
+	status       string
+	statusDetail string
+	deployStatus string
+	syncMut      sync.Mutex
+	retryMut     sync.Mutex
+	syncRetries  map[string]int
+	// 已发出sync请求、还没收到结果的文件，失败时按原来的操作重试
+	syncingMetas map[string]FileMeta
+}
+
+// newSyncTargets 没配servers时就是server这一台；多台server或多个profile时日志前面加上名字
+func newSyncTargets(p *syncProfile, multiProfile bool) []*syncTarget {
+	conf := p.conf
+	serverTargets := conf.Servers
+	if len(serverTargets) == 0 {
+		serverTargets = []ServerTarget{{Name: conf.Server, Server: conf.Server}}
+	}
+	var syncTargets []*syncTarget
+	for index, serverTarget := range serverTargets {
+		t := &syncTarget{
+			profile:        p,
+			name:           serverTarget.Name,
+			server:         serverTarget.Server,
+			project:        serverTarget.Project,
+			secret:         serverTarget.Secret,
+			tls:            serverTarget.Tls || conf.Tls,
+			tlsFingerprint: serverTarget.TlsFingerprint,
+			messageChan:    make(chan WsReqMessage, 10),
+			codec:          CodecNone,
+			hashAlgo:       HashXxhash,
+			offlineChanges: make(map[string]FileMeta),
+			status:         targetConnecting,
+			syncRetries:    make(map[string]int),
+			syncingMetas:   make(map[string]FileMeta),
+		}
+		if t.name == "" {
+			t.name = fmt.Sprintf("server%d", index+1)
+		}
+		// 没单独配的沿用外层配置
+		if t.project == "" {
+			t.project = conf.Project
+		}
+		if t.project == "" {
+			t.project = conf.Name
+		}
+		if t.secret == "" {
+			t.secret = conf.Secret
+		}
+		if t.tlsFingerprint == "" {
+			t.tlsFingerprint = conf.TlsFingerprint
+		}
+		prefix := ""
+		switch {
+		case multiProfile && len(serverTargets) > 1:
+			prefix = "[" + p.name + "/" + t.name + "] "
+		case multiProfile:
+			prefix = "[" + p.name + "] "
+		case len(serverTargets) > 1:
+			prefix = "[" + t.name + "] "
+		}
+		t.log = log.New(os.Stderr, prefix, log.LstdFlags|log.Lmsgprefix)
+		syncTargets = append(syncTargets, t)
+	}
+	return syncTargets
+}
+
+// setStatus 更新同步状态，一批同步有了结果时打印各台server的汇总
+func (t *syncTarget) setStatus(status string, detail string, summary bool) {
+	t.connMut.Lock()
+	t.status = status
+	t.statusDetail = detail
+	t.connMut.Unlock()
+	if summary {
+		t.profile.printSummary()
+	}
+}
+
+func (t *syncTarget) setLastDeploySeq(seq int64) {
+	t.connMut.Lock()
+	t.lastDeploySeq = seq
+	t.connMut.Unlock()
+}
+
+func (t *syncTarget) setDeployStatus(deployStatus string) {
+	t.connMut.Lock()
+	t.deployStatus = deployStatus
+	t.connMut.Unlock()
+}
+
+// printSummary 只有一台server时每条日志已经说明了结果，不打印
+func (p *syncProfile) printSummary() {
+	if len(p.targets) < 2 {
+		return
+	}
+	upToDate := 0
+	var lines []string
+	for _, t := range p.targets {
+		t.connMut.Lock()
+		line := fmt.Sprintf("  %s(%s): %s", t.name, t.server, t.status)
+		if t.statusDetail != "" {
+			line += ", " + t.statusDetail
+		}
+		if t.deployStatus != "" {
+			line += ", deploy: " + t.deployStatus
+		}
+		if t.status == targetUpToDate {
+			upToDate++
+		}
+		t.connMut.Unlock()
+		lines = append(lines, line)
+	}
+	p.log.Printf(PreLog+" summary: %d/%d servers up to date\n%s", upToDate, len(p.targets), strings.Join(lines, "\n"))
+}
+
+// fanOutChanges 一批改动分发给每台server，各自diff；断线的先记下来
+func (p *syncProfile) fanOutChanges(fileChanges []FileMeta) {
+	for _, t := range p.targets {
+		targetChanges := make([]FileMeta, len(fileChanges))
+		copy(targetChanges, fileChanges)
+		if !t.recordOfflineChanges(targetChanges) {
+			t.handleChanges(targetChanges)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCertFile = "syncds-server.crt"
+	defaultKeyFile  = "syncds-server.key"
+)
+
+// certFingerprint 证书DER的sha256，格式同`openssl x509 -noout -fingerprint -sha256`
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+func normalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.Replace(fingerprint, ":", "", -1)
+	fingerprint = strings.Replace(fingerprint, " ", "", -1)
+	return strings.ToLower(fingerprint)
+}
+
+// ensureServerCert 没有配置证书或证书文件不存在时，生成自签名证书并保存，返回证书、私钥路径
+func ensureServerCert(conf ServerConf) (string, string, error) {
+	certFile := conf.TlsCertFile
+	keyFile := conf.TlsKeyFile
+	if certFile == "" {
+		certFile = defaultCertFile
+	}
+	if keyFile == "" {
+		keyFile = defaultKeyFile
+	}
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if certErr == nil && keyErr == nil {
+		return certFile, keyFile, nil
+	}
+	if !os.IsNotExist(certErr) || !os.IsNotExist(keyErr) {
+		return "", "", fmt.Errorf("tls cert %s and key %s should both exist, cert err: %v, key err: %v", certFile, keyFile, certErr, keyErr)
+	}
+	log.Printf(PreLog+" tls cert %s not found, generate a self-signed one", certFile)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+	tpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "syncds " + conf.Name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	host, _, err := net.SplitHostPort(conf.Server)
+	if err == nil && host != "" {
+		if ip := net.ParseIP(host); ip != nil {
+			tpl.IPAddresses = append(tpl.IPAddresses, ip)
+		} else {
+			tpl.DNSNames = append(tpl.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tpl, &tpl, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return "", "", err
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+// logCertFingerprint 打印证书指纹，填到client的tls-fingerprint
+func logCertFingerprint(certFile string, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	log.Printf(PreLog+" tls enabled, cert fingerprint (sha256): %s", certFingerprint(cert.Certificate[0]))
+	return nil
+}
+
+// pinnedTlsConfig 没有内部CA，不校验证书链，只校验server证书指纹
+func pinnedTlsConfig(fingerprint string) *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("server presented no certificate")
+			}
+			actual := certFingerprint(rawCerts[0])
+			if fingerprint == "" {
+				return fmt.Errorf("tls-fingerprint not configured, server cert fingerprint is %s, check it on the server log and set it in %s", actual, fileNameClientConfig)
+			}
+			if normalizeFingerprint(actual) != normalizeFingerprint(fingerprint) {
+				return fmt.Errorf("server cert fingerprint mismatch, expect %s, got %s", fingerprint, actual)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	chunkSize            = 512 * 1024
+	chunkAckTimeout      = 30 * time.Second
+	maxParallelTransfers = 3
+	// 名字带.syncds-，目录hash树会跳过
+	stagingDirName = ".syncds-tmp"
+)
+
+type (
+	// ChunkReq 大文件分片传输，每片都要等server ack后再发下一片
+	ChunkReq struct {
+		TransferId int64
+		FilePath   string
+		Seq        int
+		Data       []byte
+		Last       bool
+		Hash       string // 最后一片带上整个文件的hash，server落盘前校验
+		// 非0表示传的是增量，server按旧文件还原
+		DeltaBlockSize int
+		DeltaBaseSize  int64
+		Codec          string // 本片的压缩算法，空表示未压缩
+	}
+	ChunkAck struct {
+		TransferId int64
+		Seq        int
+		Error      string
+	}
+	// transferResult 一个文件的上传结果，RawBytes是文件大小，SentBytes是实际传输的字节数
+	transferResult struct {
+		Err       error
+		RawBytes  int64
+		SentBytes int64
+	}
+)
+
+var (
+	lastTransferId int64
+	chunkAckMut    sync.Mutex
+	chunkAcks      = make(map[int64]chan ChunkAck)
+)
+
+// streamFiles 分片并发上传文件，返回每个文件的结果
+func (t *syncTarget) streamFiles(fileChanges []FileMeta) map[string]transferResult {
+	var resultMut sync.Mutex
+	results := make(map[string]transferResult)
+	sem := make(chan struct{}, maxParallelTransfers)
+	var wg sync.WaitGroup
+	for _, fileMeta := range fileChanges {
+		// 只有写入要传内容，软链接和只改属性的文件也不用传
+		if fileMeta.OptType != OptWrite || fileMeta.LinkTarget != "" || fileMeta.AttrOnly {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(fileMeta FileMeta) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			result := t.streamFile(fileMeta)
+			resultMut.Lock()
+			results[fileMeta.FilePath] = result
+			resultMut.Unlock()
+		}(fileMeta)
+	}
+	wg.Wait()
+	return results
+}
+
+func (t *syncTarget) streamFile(fileMeta FileMeta) transferResult {
+	filePath := filepath.Join(t.profile.conf.BaseDir, fileMeta.FilePath)
+	// server有旧版本时优先传增量，失败再全量
+	if fileMeta.Signature != nil {
+		result := t.streamDelta(fileMeta, filePath)
+		if result.Err == nil {
+			return result
+		}
+		t.log.Printf(PreLog+" delta sync %s skipped, send whole file: %v", fileMeta.FilePath, result.Err)
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return transferResult{Err: err}
+	}
+	defer file.Close()
+	t.connMut.Lock()
+	hasher := newHasher(t.hashAlgo)
+	t.connMut.Unlock()
+	counter := &countingWriter{}
+	sentBytes, err := t.sendChunks(io.TeeReader(file, io.MultiWriter(hasher, counter)), ChunkReq{FilePath: fileMeta.FilePath}, func() string {
+		return hex.EncodeToString(hasher.Sum(nil))
+	})
+	return transferResult{err, counter.n, sentBytes}
+}
+
+func (t *syncTarget) streamDelta(fileMeta FileMeta, filePath string) transferResult {
+	sig := fileMeta.Signature
+	deltaPath, hashCode, literalBytes, err := buildDelta(filePath, sig)
+	if err != nil {
+		return transferResult{Err: err}
+	}
+	defer os.Remove(deltaPath)
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return transferResult{Err: err}
+	}
+	// 改动太多时增量不划算
+	if literalBytes > stat.Size()/2 {
+		return transferResult{Err: fmt.Errorf("%s of %s changed", FormatFileSize(literalBytes), FormatFileSize(stat.Size()))}
+	}
+	deltaFile, err := os.Open(deltaPath)
+	if err != nil {
+		return transferResult{Err: err}
+	}
+	defer deltaFile.Close()
+	deltaStat, err := deltaFile.Stat()
+	if err != nil {
+		return transferResult{Err: err}
+	}
+	t.log.Printf(PreLog+" delta sync %s, send %s of %s", fileMeta.FilePath, FormatFileSize(deltaStat.Size()), FormatFileSize(stat.Size()))
+	head := ChunkReq{
+		FilePath:       fileMeta.FilePath,
+		DeltaBlockSize: sig.BlockSize,
+		DeltaBaseSize:  sig.Size,
+	}
+	sentBytes, err := t.sendChunks(deltaFile, head, func() string {
+		return hashCode
+	})
+	return transferResult{err, stat.Size(), sentBytes}
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// sendChunks 按chunkSize切片发送，head带上文件路径等公共字段，最后一片带上hash，返回实际发送的字节数
+func (t *syncTarget) sendChunks(reader io.Reader, head ChunkReq, hashCode func() string) (int64, error) {
+	t.connMut.Lock()
+	sessionCodec := t.codec
+	t.connMut.Unlock()
+	if !shouldCompress(head.FilePath) {
+		sessionCodec = CodecNone
+	}
+	var sentBytes int64
+
+	transferId := atomic.AddInt64(&lastTransferId, 1)
+	ackChan := make(chan ChunkAck, 1)
+	chunkAckMut.Lock()
+	chunkAcks[transferId] = ackChan
+	chunkAckMut.Unlock()
+	defer func() {
+		chunkAckMut.Lock()
+		delete(chunkAcks, transferId)
+		chunkAckMut.Unlock()
+	}()
+
+	buf := make([]byte, chunkSize)
+	for seq := 0; ; seq++ {
+		n, err := io.ReadFull(reader, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return sentBytes, err
+		}
+		req := head
+		req.TransferId = transferId
+		req.Seq = seq
+		req.Data = buf[:n]
+		req.Last = last
+		if last {
+			req.Hash = hashCode()
+		}
+		// 压缩后没变小就发原始数据
+		if sessionCodec != CodecNone && n > 0 {
+			compressed, err := compressChunk(sessionCodec, req.Data)
+			if err == nil && len(compressed) < n {
+				req.Data = compressed
+				req.Codec = sessionCodec
+			}
+		}
+		sentBytes += int64(len(req.Data))
+		t.sendWsReq("chunk", req)
+
+		select {
+		case ack := <-ackChan:
+			if ack.Error != "" {
+				return sentBytes, fmt.Errorf("server rejected chunk %d: %s", ack.Seq, ack.Error)
+			}
+		case <-time.After(chunkAckTimeout):
+			return sentBytes, fmt.Errorf("wait ack of chunk %d timeout", seq)
+		}
+		if last {
+			return sentBytes, nil
+		}
+	}
+}
+
+// dispatchChunkAck 读协程收到ack后交给对应的上传协程
+func dispatchChunkAck(data string) {
+	var ack ChunkAck
+	err := json.Unmarshal([]byte(data), &ack)
+	if err != nil {
+		log.Printf(PreError+" read chunkAck err: %v", err)
+		return
+	}
+	chunkAckMut.Lock()
+	ackChan, ok := chunkAcks[ack.TransferId]
+	chunkAckMut.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case ackChan <- ack:
+	default:
+	}
+}
+
+// transfer server端正在接收的文件，先写临时文件，最后一片到达并校验后再rename
+type transfer struct {
+	filePath string
+	tmpPath  string
+	file     *os.File
+	nextSeq  int
+	hasher   hash.Hash
+	// 增量传输时file写的是增量，最后再还原到tmpPath
+	deltaPath      string
+	deltaBlockSize int
+	deltaBaseSize  int64
+}
+
+// stagedFile 收完并校验过的临时文件，hash是server按最终内容算出来的
+type stagedFile struct {
+	tmpPath string
+	hash    string
+}
+
+func (session *Session) handleChunk(req ChunkReq) {
+	err := session.receiveChunk(req)
+	ack := ChunkAck{TransferId: req.TransferId, Seq: req.Seq}
+	if err != nil {
+		log.Printf(PreError+" receive chunk %d of %s err: %v", req.Seq, req.FilePath, err)
+		ack.Error = err.Error()
+		session.abortTransfer(req.TransferId)
+	}
+	ackBytes, _ := json.Marshal(ack)
+	session.writeJson("chunkAck", string(ackBytes))
+}
+
+func (session *Session) receiveChunk(req ChunkReq) error {
+	t, ok := session.transfers[req.TransferId]
+	if !ok {
+		if req.Seq != 0 {
+			return fmt.Errorf("unknown transfer %d", req.TransferId)
+		}
+		var err error
+		t, err = newTransfer(session.project, req, session.Hash, strconv.FormatInt(session.Id, 10)+"-"+strconv.FormatInt(req.TransferId, 10))
+		if err != nil {
+			return err
+		}
+		session.transfers[req.TransferId] = t
+	}
+	if req.Seq != t.nextSeq {
+		return fmt.Errorf("expect chunk %d, got %d", t.nextSeq, req.Seq)
+	}
+	data := req.Data
+	if req.Codec != "" && req.Codec != CodecNone {
+		var err error
+		data, err = decompressChunk(req.Codec, req.Data)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := t.file.Write(data)
+	if err != nil {
+		return err
+	}
+	t.hasher.Write(data)
+	t.nextSeq++
+	if !req.Last {
+		return nil
+	}
+
+	delete(session.transfers, req.TransferId)
+	err = t.file.Close()
+	if err != nil {
+		_ = os.Remove(t.tmpPath)
+		return err
+	}
+	hashCode := hex.EncodeToString(t.hasher.Sum(nil))
+	if t.deltaPath != "" {
+		hashCode, err = applyDelta(session.Hash, t.filePath, t.deltaPath, t.tmpPath, t.deltaBlockSize, t.deltaBaseSize)
+		_ = os.Remove(t.deltaPath)
+		if err != nil {
+			_ = os.Remove(t.tmpPath)
+			return err
+		}
+	}
+	if req.Hash != "" && req.Hash != hashCode {
+		_ = os.Remove(t.tmpPath)
+		return fmt.Errorf("%s mismatch, expect %s, got %s", session.Hash, req.Hash, hashCode)
+	}
+	// 覆盖已有文件时沿用原来的权限
+	if stat, err := os.Lstat(t.filePath); err == nil {
+		_ = os.Chmod(t.tmpPath, stat.Mode().Perm())
+	}
+	// 先留在临时文件，等sync请求到了整批一起替换
+	if old, ok := session.staged[t.filePath]; ok {
+		_ = os.Remove(old.tmpPath)
+	}
+	session.staged[t.filePath] = stagedFile{t.tmpPath, hashCode}
+	log.Printf(PreLog+" sync, file received: %s", req.FilePath)
+	return nil
+}
+
+func newTransfer(sp *serverProject, req ChunkReq, algo string, tmpSuffix string) (*transfer, error) {
+	filePath, err := sp.resolveSyncPath(req.FilePath)
+	if err != nil {
+		return nil, err
+	}
+	// 增量的基础文件必须是普通文件，不能读软链接指向的内容
+	if req.DeltaBlockSize > 0 {
+		if stat, err := os.Lstat(filePath); err != nil || !stat.Mode().IsRegular() {
+			return nil, fmt.Errorf("delta base %s is not a regular file", req.FilePath)
+		}
+	}
+	// 临时文件统一放在base-dir下的暂存目录，目标目录等到sync时才创建，改名的目录才能整体挪过去
+	baseDir, err := sp.realBaseDir()
+	if err != nil {
+		return nil, err
+	}
+	stagingDir := filepath.Join(baseDir, stagingDirName)
+	err = os.MkdirAll(stagingDir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	t := &transfer{
+		filePath: filePath,
+		tmpPath:  filepath.Join(stagingDir, tmpSuffix+"-"+filepath.Base(filePath)),
+		hasher:   newHasher(algo),
+	}
+	receivePath := t.tmpPath
+	if req.DeltaBlockSize > 0 {
+		t.deltaPath = t.tmpPath + ".delta"
+		t.deltaBlockSize = req.DeltaBlockSize
+		t.deltaBaseSize = req.DeltaBaseSize
+		receivePath = t.deltaPath
+	}
+	t.file, err = os.OpenFile(receivePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (session *Session) abortTransfer(transferId int64) {
+	t, ok := session.transfers[transferId]
+	if !ok {
+		return
+	}
+	delete(session.transfers, transferId)
+	_ = t.file.Close()
+	_ = os.Remove(t.tmpPath)
+	if t.deltaPath != "" {
+		_ = os.Remove(t.deltaPath)
+	}
+}
+
+// abortTransfers 连接断开时清理没传完、没提交的临时文件
+func (session *Session) abortTransfers() {
+	for transferId := range session.transfers {
+		session.abortTransfer(transferId)
+	}
+	for filePath, staged := range session.staged {
+		delete(session.staged, filePath)
+		_ = os.Remove(staged.tmpPath)
+	}
+}